@@ -0,0 +1,224 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balance strategy of targets.
+const (
+	StrategyRoundRobin     = "round_robin"     // default
+	StrategyWeighted       = "weighted"        // smooth weighted round robin
+	StrategyConsistentHash = "consistent_hash" // same hash key goes to same target
+)
+
+// Hash key of consistent hash strategy.
+const (
+	HashKeyClientIp     = "client_ip" // default
+	HashKeyHeaderPrefix = "header:"   // such as: 'header:X-User-Id', fallback to client ip if header not found
+)
+
+const (
+	defaultMaxFails      = 3
+	defaultEjectMs       = 30000
+	virtualNodesOfWeight = 100 // virtual nodes of each weight unit in hash ring
+)
+
+var ErrNoHealthyTarget = errors.New("no healthy target")
+
+type Target struct {
+	Url    string `yaml:"url"`    // base url, path and query of original request are appended to it
+	Weight int    `yaml:"weight"` // default 1
+}
+
+type Config struct {
+	Strategy string `yaml:"strategy"` // round_robin, weighted, consistent_hash, default round_robin
+	HashKey  string `yaml:"hash_key"` // client_ip, header:{name}, default client_ip
+
+	// passive health check, target is ejected after consecutive failures, failure is transport error or 5xx status.
+	MaxFails int `yaml:"max_fails"` // default 3, negative disable health check
+	EjectMs  int `yaml:"eject_ms"`  // default 30000
+}
+
+type Endpoint struct {
+	Url    *url.URL
+	Weight int
+
+	currentWeight int
+	fails         int
+	ejectedUntil  time.Time
+}
+
+func (endpoint *Endpoint) String() string {
+	return endpoint.Url.String()
+}
+
+type ringNode struct {
+	hash     uint32
+	endpoint *Endpoint
+}
+
+// Balancer pick target of request, ejected targets are skipped until eject timeout.
+type Balancer struct {
+	config    *Config
+	endpoints []*Endpoint
+	ring      []*ringNode // sorted by hash, used by consistent hash strategy
+
+	mutex sync.Mutex
+	next  int
+}
+
+func New(targets []*Target, config *Config) (*Balancer, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("targets is empty")
+	}
+	if nil == config {
+		config = &Config{}
+	}
+	if len(config.Strategy) == 0 {
+		config.Strategy = StrategyRoundRobin
+	}
+	if len(config.HashKey) == 0 {
+		config.HashKey = HashKeyClientIp
+	}
+	if config.MaxFails == 0 {
+		config.MaxFails = defaultMaxFails
+	}
+	if config.EjectMs <= 0 {
+		config.EjectMs = defaultEjectMs
+	}
+	switch config.Strategy {
+	case StrategyRoundRobin, StrategyWeighted, StrategyConsistentHash:
+	default:
+		return nil, fmt.Errorf("invalid balance strategy '%s', support round_robin, weighted, consistent_hash", config.Strategy)
+	}
+	if config.HashKey != HashKeyClientIp && (!strings.HasPrefix(config.HashKey, HashKeyHeaderPrefix) || len(config.HashKey) == len(HashKeyHeaderPrefix)) {
+		return nil, fmt.Errorf("invalid hash key '%s', support client_ip, header:{name}", config.HashKey)
+	}
+
+	balancer := &Balancer{config: config}
+	for _, target := range targets {
+		if nil == target || len(strings.TrimSpace(target.Url)) == 0 {
+			return nil, errors.New("target url is empty")
+		}
+		targetUrl, err := url.Parse(target.Url)
+		if nil != err {
+			return nil, err
+		}
+		weight := target.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		endpoint := &Endpoint{Url: targetUrl, Weight: weight}
+		balancer.endpoints = append(balancer.endpoints, endpoint)
+		for i := 0; i < weight*virtualNodesOfWeight; i++ {
+			hash := crc32.ChecksumIEEE([]byte(target.Url + "#" + strconv.Itoa(i)))
+			balancer.ring = append(balancer.ring, &ringNode{hash: hash, endpoint: endpoint})
+		}
+	}
+	sort.Slice(balancer.ring, func(i, j int) bool {
+		return balancer.ring[i].hash < balancer.ring[j].hash
+	})
+	return balancer, nil
+}
+
+// Hash key of request for consistent hash strategy.
+func (balancer *Balancer) HashKey(request *http.Request, clientIp string) string {
+	if strings.HasPrefix(balancer.config.HashKey, HashKeyHeaderPrefix) {
+		if value := request.Header.Get(strings.TrimPrefix(balancer.config.HashKey, HashKeyHeaderPrefix)); len(value) > 0 {
+			return value
+		}
+	}
+	return clientIp
+}
+
+// Pick healthy target, hash key is used by consistent hash strategy only.
+func (balancer *Balancer) Next(hashKey string) (*Endpoint, error) {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	now := time.Now()
+
+	switch balancer.config.Strategy {
+	case StrategyWeighted:
+		// smooth weighted round robin, See: https://github.com/phusion/nginx/commit/27e94984486058d73157038f7950a0a36ecc6e35
+		var best *Endpoint
+		total := 0
+		for _, endpoint := range balancer.endpoints {
+			if !balancer.isHealthy(endpoint, now) {
+				continue
+			}
+			endpoint.currentWeight += endpoint.Weight
+			total += endpoint.Weight
+			if nil == best || endpoint.currentWeight > best.currentWeight {
+				best = endpoint
+			}
+		}
+		if nil == best {
+			return nil, ErrNoHealthyTarget
+		}
+		best.currentWeight -= total
+		return best, nil
+	case StrategyConsistentHash:
+		hash := crc32.ChecksumIEEE([]byte(hashKey))
+		start := sort.Search(len(balancer.ring), func(i int) bool {
+			return balancer.ring[i].hash >= hash
+		})
+		// walk clockwise to first healthy target
+		for i := 0; i < len(balancer.ring); i++ {
+			node := balancer.ring[(start+i)%len(balancer.ring)]
+			if balancer.isHealthy(node.endpoint, now) {
+				return node.endpoint, nil
+			}
+		}
+		return nil, ErrNoHealthyTarget
+	default:
+		for i := 0; i < len(balancer.endpoints); i++ {
+			endpoint := balancer.endpoints[balancer.next]
+			balancer.next = (balancer.next + 1) % len(balancer.endpoints)
+			if balancer.isHealthy(endpoint, now) {
+				return endpoint, nil
+			}
+		}
+		return nil, ErrNoHealthyTarget
+	}
+}
+
+// Report result of request, target is ejected if consecutive failures reach max fails.
+func (balancer *Balancer) Report(endpoint *Endpoint, success bool) {
+	if balancer.config.MaxFails < 0 {
+		return
+	}
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	if success {
+		endpoint.fails = 0
+		return
+	}
+	endpoint.fails++
+	if endpoint.fails >= balancer.config.MaxFails && !endpoint.ejectedUntil.After(time.Now()) {
+		endpoint.ejectedUntil = time.Now().Add(time.Duration(balancer.config.EjectMs) * time.Millisecond)
+		log.Printf("[Balancer] target '%s' is ejected for %dms after %d consecutive failures.", endpoint, balancer.config.EjectMs, endpoint.fails)
+	}
+}
+
+// Target is healthy after eject timeout, it's ejected again by next failure, caller must hold mutex.
+func (balancer *Balancer) isHealthy(endpoint *Endpoint, now time.Time) bool {
+	if endpoint.ejectedUntil.IsZero() {
+		return true
+	}
+	if endpoint.ejectedUntil.After(now) {
+		return false
+	}
+	endpoint.ejectedUntil = time.Time{}
+	endpoint.fails = balancer.config.MaxFails - 1
+	return true
+}
@@ -0,0 +1,191 @@
+package balancer
+
+import (
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestBalancer(t *testing.T, weights []int, config *Config) *Balancer {
+	var targets []*Target
+	for i, weight := range weights {
+		targets = append(targets, &Target{Url: "http://target-" + string(rune('a'+i)), Weight: weight})
+	}
+	balancer, err := New(targets, config)
+	if nil != err {
+		t.Fatalf("new balancer fail, cause: %v", err)
+	}
+	return balancer
+}
+
+func pick(t *testing.T, balancer *Balancer, hashKey string) string {
+	endpoint, err := balancer.Next(hashKey)
+	if nil != err {
+		t.Fatalf("next fail, cause: %v", err)
+	}
+	return endpoint.Url.Host
+}
+
+func TestSmoothWeightedRoundRobin(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights []int
+		expects []string
+	}{
+		{"equal weights", []int{1, 1, 1}, []string{"target-a", "target-b", "target-c", "target-a", "target-b", "target-c"}},
+		{"default weight is 1", []int{0, 2}, []string{"target-b", "target-a", "target-b", "target-b", "target-a", "target-b"}},
+		{"heavy target is spread", []int{5, 1, 1}, []string{"target-a", "target-a", "target-b", "target-a", "target-c", "target-a", "target-a"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			balancer := newTestBalancer(t, c.weights, &Config{Strategy: StrategyWeighted})
+			for i, expect := range c.expects {
+				if actual := pick(t, balancer, ""); actual != expect {
+					t.Fatalf("pick %d expect %s, actual %s", i, expect, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinSkipEjected(t *testing.T) {
+	balancer := newTestBalancer(t, []int{1, 1, 1}, &Config{MaxFails: 1})
+	balancer.Report(balancer.endpoints[1], false)
+	expects := []string{"target-a", "target-c", "target-a", "target-c"}
+	for i, expect := range expects {
+		if actual := pick(t, balancer, ""); actual != expect {
+			t.Fatalf("pick %d expect %s, actual %s", i, expect, actual)
+		}
+	}
+}
+
+func TestConsistentHashRingWalk(t *testing.T) {
+	cases := []struct {
+		name    string
+		hashKey string
+	}{
+		{"client ip", "10.0.0.1"},
+		{"another client ip", "192.168.1.20"},
+		{"header value", "user-42"},
+		{"empty key", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			balancer := newTestBalancer(t, []int{1, 2, 1}, &Config{Strategy: StrategyConsistentHash, MaxFails: 1})
+			first := pick(t, balancer, c.hashKey)
+			for i := 0; i < 10; i++ {
+				if actual := pick(t, balancer, c.hashKey); actual != first {
+					t.Fatalf("same key expect %s, actual %s", first, actual)
+				}
+			}
+
+			// eject picked target, key walk clockwise to next healthy target.
+			var picked *Endpoint
+			for _, endpoint := range balancer.endpoints {
+				if endpoint.Url.Host == first {
+					picked = endpoint
+				}
+			}
+			expect := ""
+			for i := 0; i < len(balancer.ring); i++ {
+				node := balancer.ring[(ringStart(balancer, c.hashKey)+i)%len(balancer.ring)]
+				if node.endpoint != picked {
+					expect = node.endpoint.Url.Host
+					break
+				}
+			}
+			balancer.Report(picked, false)
+			if actual := pick(t, balancer, c.hashKey); actual != expect {
+				t.Fatalf("ejected target expect walk to %s, actual %s", expect, actual)
+			}
+
+			// target is back after eject timeout.
+			picked.ejectedUntil = time.Now().Add(-time.Millisecond)
+			if actual := pick(t, balancer, c.hashKey); actual != first {
+				t.Fatalf("recovered target expect %s, actual %s", first, actual)
+			}
+		})
+	}
+}
+
+// Index of first ring node of hash key, same as Next.
+func ringStart(balancer *Balancer, hashKey string) int {
+	hash := crc32.ChecksumIEEE([]byte(hashKey))
+	return sort.Search(len(balancer.ring), func(i int) bool {
+		return balancer.ring[i].hash >= hash
+	})
+}
+
+func TestEjectAndHalfOpenRecovery(t *testing.T) {
+	cases := []struct {
+		name    string
+		reports []bool // reports of target-a, in order
+		ejected bool   // target-a ejected after reports
+	}{
+		{"fails below max", []bool{false, false}, false},
+		{"consecutive fails reach max", []bool{false, false, false}, true},
+		{"success reset fails", []bool{false, false, true, false, false}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			balancer := newTestBalancer(t, []int{1, 1}, &Config{MaxFails: 3, EjectMs: 60000})
+			target := balancer.endpoints[0]
+			for _, success := range c.reports {
+				balancer.Report(target, success)
+			}
+			if actual := !balancer.isHealthy(target, time.Now()); actual != c.ejected {
+				t.Fatalf("ejected expect %v, actual %v", c.ejected, actual)
+			}
+		})
+	}
+
+	// half open: target is picked again after eject timeout, one failure eject it again, success close it.
+	balancer := newTestBalancer(t, []int{1, 1}, &Config{MaxFails: 2, EjectMs: 60000})
+	target := balancer.endpoints[0]
+	balancer.Report(target, false)
+	balancer.Report(target, false)
+	for i := 0; i < 4; i++ {
+		if actual := pick(t, balancer, ""); actual != "target-b" {
+			t.Fatalf("ejected target is picked: %s", actual)
+		}
+	}
+	target.ejectedUntil = time.Now().Add(-time.Millisecond)
+	if actual := pick(t, balancer, ""); actual != "target-a" {
+		t.Fatalf("half open target expect picked, actual %s", actual)
+	}
+	balancer.Report(target, false)
+	if balancer.isHealthy(target, time.Now()) {
+		t.Fatal("half open target expect ejected by one failure")
+	}
+
+	target.ejectedUntil = time.Now().Add(-time.Millisecond)
+	balancer.isHealthy(target, time.Now())
+	balancer.Report(target, true)
+	balancer.Report(target, false)
+	if !balancer.isHealthy(target, time.Now()) {
+		t.Fatal("recovered target expect healthy after one failure")
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	cases := []struct {
+		name    string
+		hashKey string
+		header  http.Header
+		expect  string
+	}{
+		{"client ip", HashKeyClientIp, http.Header{"X-User-Id": {"42"}}, "10.0.0.1"},
+		{"header", "header:X-User-Id", http.Header{"X-User-Id": {"42"}}, "42"},
+		{"missing header fallback to client ip", "header:X-User-Id", http.Header{}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			balancer := newTestBalancer(t, []int{1}, &Config{Strategy: StrategyConsistentHash, HashKey: c.hashKey})
+			if actual := balancer.HashKey(&http.Request{Header: c.header}, "10.0.0.1"); actual != c.expect {
+				t.Fatalf("expect %s, actual %s", c.expect, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultReloadIntervalMs = 10000
+
+// Client certificate verify mode.
+const (
+	ClientAuthNone             = "none"
+	ClientAuthRequest          = "request"
+	ClientAuthRequire          = "require"
+	ClientAuthVerifyIfGiven    = "verify_if_given"
+	ClientAuthRequireAndVerify = "require_and_verify"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                         tls.NoClientCert,
+	ClientAuthNone:             tls.NoClientCert,
+	ClientAuthRequest:          tls.RequestClientCert,
+	ClientAuthRequire:          tls.RequireAnyClientCert,
+	ClientAuthVerifyIfGiven:    tls.VerifyClientCertIfGiven,
+	ClientAuthRequireAndVerify: tls.RequireAndVerifyClientCert,
+}
+
+type KeyPair struct {
+	Cert string `yaml:"cert"` // PEM certificate chain file
+	Key  string `yaml:"key"`  // PEM private key file
+}
+
+type keyPairEntry struct {
+	keyPair *KeyPair
+	modTime time.Time
+	tlsCert *tls.Certificate
+}
+
+// Hold server certificates and client CA, select certificate by SNI, reload them when file changed.
+type CertStore struct {
+	mutex sync.RWMutex
+
+	entries    []*keyPairEntry
+	clientCa   string
+	caModTime  time.Time
+	caPool     *x509.CertPool
+	clientAuth tls.ClientAuthType
+
+	reloadInterval time.Duration
+	exitChan       chan struct{} // closed by Close, stop watching files
+	closeOnce      sync.Once
+}
+
+func NewCertStore(keyPairs []*KeyPair, clientCa, clientAuth string, reloadIntervalMs int) (*CertStore, error) {
+	if len(keyPairs) == 0 {
+		return nil, errors.New("certificate is empty")
+	}
+	authType, ok := clientAuthTypes[strings.ToLower(clientAuth)]
+	if !ok {
+		return nil, errors.New("invalid client auth type: " + clientAuth)
+	}
+	if authType >= tls.VerifyClientCertIfGiven && len(strings.TrimSpace(clientCa)) == 0 {
+		return nil, errors.New("client ca is empty, can't verify client certificate")
+	}
+	if reloadIntervalMs <= 0 {
+		reloadIntervalMs = defaultReloadIntervalMs
+	}
+
+	store := &CertStore{
+		mutex:          sync.RWMutex{},
+		clientCa:       clientCa,
+		clientAuth:     authType,
+		reloadInterval: time.Duration(reloadIntervalMs) * time.Millisecond,
+		exitChan:       make(chan struct{}),
+	}
+	for _, keyPair := range keyPairs {
+		if nil == keyPair {
+			continue
+		}
+		store.entries = append(store.entries, &keyPairEntry{keyPair: keyPair})
+	}
+	if len(store.entries) == 0 {
+		return nil, errors.New("certificate is empty")
+	}
+
+	// first load must success.
+	if _, err := store.reload(); nil != err {
+		return nil, err
+	}
+	go store.watch()
+	return store, nil
+}
+
+// Build tls config for http server, the certificate and client CA always use latest loaded.
+func (store *CertStore) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		ClientAuth:     store.clientAuth,
+		MinVersion:     tls.VersionTLS12,
+	}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		config := base.Clone()
+		config.ClientCAs = store.clientCAs()
+		config.GetConfigForClient = nil
+		return config, nil
+	}
+	return base
+}
+
+// Select certificate by SNI, return first certificate if no one match.
+func (store *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if len(hello.ServerName) > 0 {
+		for _, entry := range store.entries {
+			if nil == hello.SupportsCertificate(entry.tlsCert) {
+				return entry.tlsCert, nil
+			}
+		}
+	}
+	return store.entries[0].tlsCert, nil
+}
+
+func (store *CertStore) clientCAs() *x509.CertPool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.caPool
+}
+
+func (store *CertStore) watch() {
+	ticker := time.NewTicker(store.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if changed, err := store.reload(); nil != err {
+				log.Printf("[cert-store] reload certificate fail, keep using previous one, cause: %v", err)
+			} else if changed {
+				log.Println("[cert-store] certificate reloaded.")
+			}
+		case <-store.exitChan:
+			return
+		}
+	}
+}
+
+// Reload certificate which file modify time changed, nothing is replaced if any file load failed.
+func (store *CertStore) reload() (changed bool, err error) {
+	type loaded struct {
+		entry   *keyPairEntry
+		modTime time.Time
+		tlsCert *tls.Certificate
+	}
+	var certs []*loaded
+	for _, entry := range store.entries {
+		modTime, err := lastModTime(entry.keyPair.Cert, entry.keyPair.Key)
+		if nil != err {
+			return false, err
+		}
+		if modTime.Equal(entry.modTime) {
+			continue
+		}
+		tlsCert, err := tls.LoadX509KeyPair(entry.keyPair.Cert, entry.keyPair.Key)
+		if nil != err {
+			return false, err
+		}
+		// parse leaf, help select certificate by SNI.
+		if tlsCert.Leaf, err = x509.ParseCertificate(tlsCert.Certificate[0]); nil != err {
+			return false, err
+		}
+		certs = append(certs, &loaded{entry: entry, modTime: modTime, tlsCert: &tlsCert})
+	}
+
+	var caPool *x509.CertPool
+	var caModTime time.Time
+	if len(strings.TrimSpace(store.clientCa)) > 0 {
+		if caModTime, err = lastModTime(store.clientCa); nil != err {
+			return false, err
+		}
+		if !caModTime.Equal(store.caModTime) {
+			caPem, err := ioutil.ReadFile(store.clientCa)
+			if nil != err {
+				return false, err
+			}
+			caPool = x509.NewCertPool()
+			if !caPool.AppendCertsFromPEM(caPem) {
+				return false, errors.New("no valid certificate in client ca file: " + store.clientCa)
+			}
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, cert := range certs {
+		cert.entry.modTime = cert.modTime
+		cert.entry.tlsCert = cert.tlsCert
+	}
+	if nil != caPool {
+		store.caPool = caPool
+		store.caModTime = caModTime
+	}
+	return len(certs) > 0 || nil != caPool, nil
+}
+
+func (store *CertStore) Close() {
+	store.closeOnce.Do(func() {
+		close(store.exitChan)
+	})
+}
+
+func lastModTime(filenames ...string) (time.Time, error) {
+	var last time.Time
+	for _, filename := range filenames {
+		fileInfo, err := os.Stat(filename)
+		if nil != err {
+			return last, err
+		}
+		if fileInfo.ModTime().After(last) {
+			last = fileInfo.ModTime()
+		}
+	}
+	return last, nil
+}
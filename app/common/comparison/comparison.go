@@ -0,0 +1,132 @@
+package comparison
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Volatile headers differ between any two responses, they're never compared.
+var defaultIgnoredHeaders = []string{"Date", "Age", "Expires", "Last-Modified", "Set-Cookie", "X-Request-Id",
+	"Content-Length", "Connection", "Keep-Alive", "Transfer-Encoding"}
+
+// Ignore rules of response comparison, status code, headers and body are compared after ignored parts are removed.
+type Config struct {
+	IgnoreHeaders   []string `yaml:"ignore_headers"`    // headers not compared, volatile headers such as 'Date' are always ignored
+	IgnoreJsonPaths []string `yaml:"ignore_json_paths"` // fields removed from json body, such as: 'data.timestamp', 'items.*.id'
+	IgnoreRegexes   []string `yaml:"ignore_regexes"`    // matches removed from body, such as: '"trace_id":"[^"]*"'
+}
+
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+type Comparator struct {
+	ignoredHeaders map[string]bool
+	jsonPaths      [][]string
+	regexes        []*regexp.Regexp
+}
+
+func New(config *Config) (*Comparator, error) {
+	if nil == config {
+		config = &Config{}
+	}
+	comparator := &Comparator{ignoredHeaders: make(map[string]bool)}
+	for _, header := range append(defaultIgnoredHeaders, config.IgnoreHeaders...) {
+		comparator.ignoredHeaders[http.CanonicalHeaderKey(strings.TrimSpace(header))] = true
+	}
+	for _, jsonPath := range config.IgnoreJsonPaths {
+		jsonPath = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(jsonPath), "$"), ".")
+		if len(jsonPath) == 0 {
+			return nil, fmt.Errorf("ignore json path is empty")
+		}
+		comparator.jsonPaths = append(comparator.jsonPaths, strings.Split(jsonPath, "."))
+	}
+	for _, expr := range config.IgnoreRegexes {
+		regex, err := regexp.Compile(expr)
+		if nil != err {
+			return nil, fmt.Errorf("ignore regex '%s' is invalid, cause: %v", expr, err)
+		}
+		comparator.regexes = append(comparator.regexes, regex)
+	}
+	return comparator, nil
+}
+
+// Compare status code, headers not ignored and body with ignored parts removed.
+func (comparator *Comparator) Equal(expected *Response, actual *Response) bool {
+	if expected.Status != actual.Status || !comparator.headerEqual(expected.Header, actual.Header) {
+		return false
+	}
+	return bytes.Equal(comparator.normalizeBody(expected.Body), comparator.normalizeBody(actual.Body))
+}
+
+func (comparator *Comparator) headerEqual(expected http.Header, actual http.Header) bool {
+	for name, values := range expected {
+		if !comparator.ignoredHeaders[name] && strings.Join(values, ",") != strings.Join(actual[name], ",") {
+			return false
+		}
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok && !comparator.ignoredHeaders[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove ignored json paths from json body, json is encoded again with sorted keys, so order of fields is ignored too.
+// Then matches of ignored regexes are removed.
+func (comparator *Comparator) normalizeBody(body []byte) []byte {
+	if len(comparator.jsonPaths) > 0 && json.Valid(body) {
+		var root interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&root); nil == err {
+			for _, path := range comparator.jsonPaths {
+				removeJsonPath(root, path)
+			}
+			if encoded, err := json.Marshal(root); nil == err {
+				body = encoded
+			}
+		}
+	}
+	for _, regex := range comparator.regexes {
+		body = regex.ReplaceAll(body, nil)
+	}
+	return body
+}
+
+// Remove fields of json path, '*' match all elements of array or all fields of object, number match array index.
+// Removed array element is set to null, so indexes of other elements are kept.
+func removeJsonPath(node interface{}, path []string) {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				delete(value, key)
+			} else {
+				removeJsonPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			if path[0] != "*" && path[0] != strconv.Itoa(i) {
+				continue
+			}
+			if len(path) == 1 {
+				value[i] = nil
+			} else {
+				removeJsonPath(child, path[1:])
+			}
+		}
+	}
+}
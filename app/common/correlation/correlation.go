@@ -0,0 +1,303 @@
+package correlation
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Source of correlated value in response.
+const (
+	SourceJson   = "json"   // json path of body, such as: 'data.token', 'items.*.id'
+	SourceRegex  = "regex"  // regex of body, first capture group is value if exist
+	SourceHeader = "header" // header name, such as: 'X-Csrf-Token'
+)
+
+const (
+	defaultMaxSessions = 10000
+	defaultMinLength   = 4 // short values are too common to be replaced safely
+)
+
+// Rule extract value from production response and replay response, production value in subsequent requests
+// of same session is substituted by replay value.
+type Rule struct {
+	Name      string `yaml:"name"`
+	Source    string `yaml:"source"`     // json, regex, header
+	Expr      string `yaml:"expr"`       // json path, regex or header name
+	MinLength int    `yaml:"min_length"` // values shorter than it are ignored, default 4
+}
+
+type compiledRule struct {
+	*Rule
+	jsonPath []string
+	regex    *regexp.Regexp
+}
+
+// Correlation engine, learned values are kept per session, least recently used session is evicted.
+type Engine struct {
+	rules []*compiledRule
+
+	mutex       sync.Mutex
+	maxSessions int
+	sessions    map[string]*list.Element
+	lru         *list.List // front is most recently used
+}
+
+type sessionValues struct {
+	session string
+	values  map[string]string // production value : replay value
+}
+
+func NewEngine(rules []*Rule, maxSessions int) (*Engine, error) {
+	engine := &Engine{
+		maxSessions: maxSessions,
+		sessions:    make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+	if engine.maxSessions <= 0 {
+		engine.maxSessions = defaultMaxSessions
+	}
+	for i, rule := range rules {
+		if nil == rule || len(strings.TrimSpace(rule.Expr)) == 0 {
+			return nil, fmt.Errorf("correlation rule %d expr is empty", i)
+		}
+		if len(rule.Name) == 0 {
+			rule.Name = rule.Source + ":" + rule.Expr
+		}
+		if rule.MinLength <= 0 {
+			rule.MinLength = defaultMinLength
+		}
+		compiled := &compiledRule{Rule: rule}
+		switch rule.Source {
+		case SourceJson:
+			compiled.jsonPath = strings.Split(strings.TrimPrefix(strings.TrimPrefix(rule.Expr, "$"), "."), ".")
+		case SourceRegex:
+			regex, err := regexp.Compile(rule.Expr)
+			if nil != err {
+				return nil, fmt.Errorf("correlation rule '%s' regex is invalid, cause: %v", rule.Name, err)
+			}
+			compiled.regex = regex
+		case SourceHeader:
+			rule.Expr = http.CanonicalHeaderKey(strings.TrimSpace(rule.Expr))
+		default:
+			return nil, fmt.Errorf("correlation rule '%s' source '%s' is invalid, support json, regex, header", rule.Name, rule.Source)
+		}
+		engine.rules = append(engine.rules, compiled)
+	}
+	return engine, nil
+}
+
+func (engine *Engine) Enabled() bool {
+	return len(engine.rules) > 0
+}
+
+// Learn values of rules from production response dump and replay response, values are matched by order.
+func (engine *Engine) Learn(session string, prodResponse []byte, replayHeader http.Header, replayBody []byte) {
+	if len(engine.rules) == 0 || len(prodResponse) == 0 {
+		return
+	}
+	prodHeader, prodBody, err := readResponse(prodResponse)
+	if nil != err {
+		return
+	}
+
+	learned := make(map[string]string)
+	for _, rule := range engine.rules {
+		prodValues, replayValues := rule.extract(prodHeader, prodBody), rule.extract(replayHeader, replayBody)
+		for i := 0; i < len(prodValues) && i < len(replayValues); i++ {
+			if len(prodValues[i]) >= rule.MinLength && prodValues[i] != replayValues[i] {
+				learned[prodValues[i]] = replayValues[i]
+			}
+		}
+	}
+	if len(learned) == 0 {
+		return
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	values := engine.session(session)
+	for prodValue, replayValue := range learned {
+		values[prodValue] = replayValue
+	}
+}
+
+// Substitute learned production values in url, headers and body of request, return substituted count.
+func (engine *Engine) Apply(session string, request *http.Request) (int, error) {
+	if len(engine.rules) == 0 {
+		return 0, nil
+	}
+	engine.mutex.Lock()
+	var replacer *strings.Replacer
+	if element, ok := engine.sessions[session]; ok {
+		engine.lru.MoveToFront(element)
+		values := element.Value.(*sessionValues).values
+		// replacer prefer former pair at same position, longer value first, so value contains another is replaced whole.
+		prodValues := make([]string, 0, len(values))
+		for prodValue := range values {
+			prodValues = append(prodValues, prodValue)
+		}
+		sort.Slice(prodValues, func(i, j int) bool {
+			if len(prodValues[i]) != len(prodValues[j]) {
+				return len(prodValues[i]) > len(prodValues[j])
+			}
+			return prodValues[i] < prodValues[j]
+		})
+		pairs := make([]string, 0, len(values)*2)
+		for _, prodValue := range prodValues {
+			pairs = append(pairs, prodValue, values[prodValue])
+		}
+		replacer = strings.NewReplacer(pairs...)
+	}
+	engine.mutex.Unlock()
+	if nil == replacer {
+		return 0, nil
+	}
+
+	count := 0
+	replace := func(s string) string {
+		if replaced := replacer.Replace(s); replaced != s {
+			count++
+			return replaced
+		}
+		return s
+	}
+
+	// step 1: replace url
+	request.URL.Path = replace(request.URL.Path)
+	request.URL.RawPath = replace(request.URL.RawPath)
+	request.URL.RawQuery = replace(request.URL.RawQuery)
+
+	// step 2: replace headers
+	for name, values := range request.Header {
+		for i := range values {
+			values[i] = replace(values[i])
+		}
+		request.Header[name] = values
+	}
+
+	// step 3: replace body, content length is changed.
+	if nil != request.Body {
+		body, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if nil != err {
+			return count, err
+		}
+		body = []byte(replace(string(body)))
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request.ContentLength = int64(len(body))
+	}
+	return count, nil
+}
+
+// Values of session, caller must hold mutex.
+func (engine *Engine) session(session string) map[string]string {
+	if element, ok := engine.sessions[session]; ok {
+		engine.lru.MoveToFront(element)
+		return element.Value.(*sessionValues).values
+	}
+	values := &sessionValues{session: session, values: make(map[string]string)}
+	engine.sessions[session] = engine.lru.PushFront(values)
+	if engine.lru.Len() > engine.maxSessions {
+		oldest := engine.lru.Back()
+		engine.lru.Remove(oldest)
+		delete(engine.sessions, oldest.Value.(*sessionValues).session)
+	}
+	return values.values
+}
+
+func (rule *compiledRule) extract(header http.Header, body []byte) []string {
+	switch rule.Source {
+	case SourceHeader:
+		return header[rule.Expr]
+	case SourceRegex:
+		var values []string
+		for _, match := range rule.regex.FindAllSubmatch(body, -1) {
+			values = append(values, string(match[len(match)-1]))
+		}
+		return values
+	case SourceJson:
+		// keep numbers as they are, large numeric ids are rounded by float64.
+		var root interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&root); nil != err {
+			return nil
+		}
+		return jsonValues(root, rule.jsonPath)
+	}
+	return nil
+}
+
+// Values of json path, '*' match all elements of array or all fields of object, number match array index.
+func jsonValues(node interface{}, path []string) []string {
+	if len(path) == 0 {
+		switch value := node.(type) {
+		case string:
+			return []string{value}
+		case json.Number:
+			return []string{value.String()}
+		}
+		return nil
+	}
+
+	var values []string
+	switch value := node.(type) {
+	case map[string]interface{}:
+		if path[0] == "*" {
+			// sort keys, so values of production and replay are matched by same order.
+			keys := make([]string, 0, len(value))
+			for key := range value {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				values = append(values, jsonValues(value[key], path[1:])...)
+			}
+		} else if child, ok := value[path[0]]; ok {
+			values = jsonValues(child, path[1:])
+		}
+	case []interface{}:
+		if path[0] == "*" {
+			for _, child := range value {
+				values = append(values, jsonValues(child, path[1:])...)
+			}
+		} else if index, err := strconv.Atoi(path[0]); nil == err && index >= 0 && index < len(value) {
+			values = jsonValues(value[index], path[1:])
+		}
+	}
+	return values
+}
+
+// Header and decompressed body of response dump.
+func readResponse(dump []byte) (http.Header, []byte, error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), nil)
+	if nil != err {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if nil != err {
+		return nil, nil, err
+	}
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if nil != err {
+			return nil, nil, err
+		}
+		if body, err = ioutil.ReadAll(gzipReader); nil != err {
+			return nil, nil, err
+		}
+	}
+	return res.Header, body, nil
+}
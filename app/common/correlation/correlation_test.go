@@ -0,0 +1,247 @@
+package correlation
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Response dump like http input plugin in mirror mode.
+func responseDump(header http.Header, body []byte, gzipped bool) []byte {
+	if gzipped {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		writer.Write(body)
+		writer.Close()
+		body = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	var dump bytes.Buffer
+	fmt.Fprintf(&dump, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n", len(body))
+	header.Write(&dump)
+	dump.WriteString("\r\n")
+	dump.Write(body)
+	return dump.Bytes()
+}
+
+func TestNewEngineInvalidRule(t *testing.T) {
+	cases := []struct {
+		name string
+		rule *Rule
+	}{
+		{"nil rule", nil},
+		{"empty expr", &Rule{Source: SourceJson, Expr: " "}},
+		{"invalid regex", &Rule{Source: SourceRegex, Expr: "token=("}},
+		{"invalid source", &Rule{Source: "cookie", Expr: "token"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := NewEngine([]*Rule{c.rule}, 0); nil == err {
+				t.Fatal("new engine expect fail")
+			}
+		})
+	}
+}
+
+func TestLearnAndApply(t *testing.T) {
+	cases := []struct {
+		name         string
+		rule         *Rule
+		prodHeader   http.Header
+		prodBody     string
+		gzipped      bool
+		replayHeader http.Header
+		replayBody   string
+		reqUrl       string
+		reqHeader    http.Header
+		reqBody      string
+		expectUrl    string
+		expectHeader string // value of X-Token header
+		expectBody   string
+		expectCount  int
+	}{
+		{
+			name:        "json path",
+			rule:        &Rule{Source: SourceJson, Expr: "data.token"},
+			prodBody:    `{"data":{"token":"prod-token-1"}}`,
+			replayBody:  `{"data":{"token":"replay-token-1"}}`,
+			reqUrl:      "http://example.com/order?token=prod-token-1",
+			reqBody:     `{"token":"prod-token-1"}`,
+			expectUrl:   "http://example.com/order?token=replay-token-1",
+			expectBody:  `{"token":"replay-token-1"}`,
+			expectCount: 2,
+		},
+		{
+			name:        "json path of array elements, values matched by order",
+			rule:        &Rule{Source: SourceJson, Expr: "$.items.*.id"},
+			prodBody:    `{"items":[{"id":"prod-a"},{"id":"prod-b"}]}`,
+			replayBody:  `{"items":[{"id":"replay-a"},{"id":"replay-b"}]}`,
+			reqUrl:      "http://example.com/items/prod-b",
+			reqBody:     "ids=prod-a,prod-b",
+			expectUrl:   "http://example.com/items/replay-b",
+			expectBody:  "ids=replay-a,replay-b",
+			expectCount: 2,
+		},
+		{
+			name:        "json number beyond float64 precision",
+			rule:        &Rule{Source: SourceJson, Expr: "order.id"},
+			prodBody:    `{"order":{"id":9007199254740993}}`,
+			replayBody:  `{"order":{"id":9007199254740995}}`,
+			reqUrl:      "http://example.com/orders/9007199254740993",
+			expectUrl:   "http://example.com/orders/9007199254740995",
+			expectCount: 1,
+		},
+		{
+			name:        "overlapping values, longer value is replaced whole",
+			rule:        &Rule{Source: SourceJson, Expr: "ids.*"},
+			prodBody:    `{"ids":["abcd","abcd1234","xabcd"]}`,
+			replayBody:  `{"ids":["r-1","r-2","r-3"]}`,
+			reqUrl:      "http://example.com/items?a=abcd&b=abcd1234&c=xabcd",
+			reqBody:     "abcd1234,xabcd,abcd",
+			expectUrl:   "http://example.com/items?a=r-1&b=r-2&c=r-3",
+			expectBody:  "r-2,r-3,r-1",
+			expectCount: 2,
+		},
+		{
+			name:        "regex of gzip body",
+			rule:        &Rule{Source: SourceRegex, Expr: `name="csrf" value="(\w+)"`},
+			prodBody:    `<input name="csrf" value="prodcsrf">`,
+			gzipped:     true,
+			replayBody:  `<input name="csrf" value="replaycsrf">`,
+			reqUrl:      "http://example.com/submit",
+			reqBody:     "csrf=prodcsrf&a=1",
+			expectUrl:   "http://example.com/submit",
+			expectBody:  "csrf=replaycsrf&a=1",
+			expectCount: 1,
+		},
+		{
+			name:         "header",
+			rule:         &Rule{Source: SourceHeader, Expr: "x-csrf-token"},
+			prodHeader:   http.Header{"X-Csrf-Token": {"prod-header-token"}},
+			replayHeader: http.Header{"X-Csrf-Token": {"replay-header-token"}},
+			reqUrl:       "http://example.com/submit",
+			reqHeader:    http.Header{"X-Token": {"prod-header-token"}},
+			expectUrl:    "http://example.com/submit",
+			expectHeader: "replay-header-token",
+			expectCount:  1,
+		},
+		{
+			name:        "short value is ignored",
+			rule:        &Rule{Source: SourceJson, Expr: "id", MinLength: 6},
+			prodBody:    `{"id":"abc"}`,
+			replayBody:  `{"id":"xyz"}`,
+			reqUrl:      "http://example.com/items/abc",
+			expectUrl:   "http://example.com/items/abc",
+			expectCount: 0,
+		},
+		{
+			name:        "same value is not learned",
+			rule:        &Rule{Source: SourceJson, Expr: "id"},
+			prodBody:    `{"id":"same-id"}`,
+			replayBody:  `{"id":"same-id"}`,
+			reqUrl:      "http://example.com/items/same-id",
+			expectUrl:   "http://example.com/items/same-id",
+			expectCount: 0,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			engine, err := NewEngine([]*Rule{c.rule}, 0)
+			if nil != err {
+				t.Fatalf("new engine fail, cause: %v", err)
+			}
+			prodHeader := http.Header{}
+			for name, values := range c.prodHeader {
+				prodHeader[name] = values
+			}
+			engine.Learn("session", responseDump(prodHeader, []byte(c.prodBody), c.gzipped), c.replayHeader, []byte(c.replayBody))
+
+			request, _ := http.NewRequest(http.MethodPost, c.reqUrl, strings.NewReader(c.reqBody))
+			for name, values := range c.reqHeader {
+				request.Header[name] = values
+			}
+			count, err := engine.Apply("session", request)
+			if nil != err {
+				t.Fatalf("apply fail, cause: %v", err)
+			}
+			body, _ := ioutil.ReadAll(request.Body)
+			if count != c.expectCount {
+				t.Fatalf("count expect %d, actual %d", c.expectCount, count)
+			}
+			if request.URL.String() != c.expectUrl {
+				t.Fatalf("url expect %s, actual %s", c.expectUrl, request.URL.String())
+			}
+			if len(c.expectBody) > 0 && (string(body) != c.expectBody || request.ContentLength != int64(len(body))) {
+				t.Fatalf("body expect %s, actual %s (content length %d)", c.expectBody, body, request.ContentLength)
+			}
+			if len(c.expectHeader) > 0 && request.Header.Get("X-Token") != c.expectHeader {
+				t.Fatalf("header expect %s, actual %s", c.expectHeader, request.Header.Get("X-Token"))
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	rule := &Rule{Source: SourceJson, Expr: "token"}
+	learn := func(engine *Engine, session, prodValue, replayValue string) {
+		engine.Learn(session, responseDump(http.Header{}, []byte(`{"token":"`+prodValue+`"}`), false), http.Header{},
+			[]byte(`{"token":"`+replayValue+`"}`))
+	}
+	apply := func(engine *Engine, session, value string) string {
+		request, _ := http.NewRequest(http.MethodGet, "http://example.com/?t="+value, nil)
+		engine.Apply(session, request)
+		return request.URL.Query().Get("t")
+	}
+
+	cases := []struct {
+		name        string
+		maxSessions int
+		steps       func(engine *Engine)
+		session     string
+		value       string
+		expect      string
+	}{
+		{"values are kept per session", 10, func(engine *Engine) {
+			learn(engine, "a", "prod-token", "replay-a")
+			learn(engine, "b", "prod-token", "replay-b")
+		}, "b", "prod-token", "replay-b"},
+		{"other session is not substituted", 10, func(engine *Engine) {
+			learn(engine, "a", "prod-token", "replay-a")
+		}, "c", "prod-token", "prod-token"},
+		{"later value of session wins", 10, func(engine *Engine) {
+			learn(engine, "a", "prod-token", "replay-1")
+			learn(engine, "a", "prod-token", "replay-2")
+		}, "a", "prod-token", "replay-2"},
+		{"least recently used session is evicted", 2, func(engine *Engine) {
+			learn(engine, "a", "prod-token", "replay-a")
+			learn(engine, "b", "prod-token", "replay-b")
+			apply(engine, "a", "prod-token")
+			learn(engine, "c", "prod-token", "replay-c")
+		}, "b", "prod-token", "prod-token"},
+		{"recently used session is kept", 2, func(engine *Engine) {
+			learn(engine, "a", "prod-token", "replay-a")
+			learn(engine, "b", "prod-token", "replay-b")
+			apply(engine, "a", "prod-token")
+			learn(engine, "c", "prod-token", "replay-c")
+		}, "a", "prod-token", "replay-a"},
+		{"nothing learned without production response", 10, func(engine *Engine) {
+			engine.Learn("a", nil, http.Header{}, []byte(`{"token":"replay-a"}`))
+		}, "a", "prod-token", "prod-token"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			engine, err := NewEngine([]*Rule{rule}, c.maxSessions)
+			if nil != err {
+				t.Fatalf("new engine fail, cause: %v", err)
+			}
+			c.steps(engine)
+			if actual := apply(engine, c.session, c.value); actual != c.expect {
+				t.Fatalf("expect %s, actual %s", c.expect, actual)
+			}
+		})
+	}
+}
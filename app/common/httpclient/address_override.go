@@ -0,0 +1,104 @@
+package httpclient
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Target of unix socket, such as: 'unix:///var/run/app.sock:/api/users?id=1', request path is after socket path.
+const (
+	unixScheme     = "unix"
+	unixHostSuffix = ".unix-socket" // socket path is encoded in host, so connections of sockets are pooled separately
+	unixHostHeader = "localhost"
+)
+
+// Dialer with static host mapping, dial overridden address instead of resolving host.
+type overrideDialer struct {
+	dialer    *net.Dialer
+	overrides map[string]string // host:port or host : ip:port, ip or unix:///path
+}
+
+// Override key is 'host:port' or 'host', value is 'ip:port', 'ip' (keep original port) or 'unix:///path/to.sock'.
+func newOverrideDialer(dialer *net.Dialer, overrides map[string]string) (*overrideDialer, error) {
+	result := &overrideDialer{dialer: dialer, overrides: make(map[string]string, len(overrides))}
+	for from, to := range overrides {
+		from, to = strings.ToLower(strings.TrimSpace(from)), strings.TrimSpace(to)
+		if len(from) == 0 || len(to) == 0 {
+			return nil, fmt.Errorf("invalid host override '%s: %s'", from, to)
+		}
+		if strings.HasPrefix(to, unixScheme+"://") && len(to) == len(unixScheme+"://") {
+			return nil, fmt.Errorf("invalid host override '%s: %s', socket path is empty", from, to)
+		}
+		result.overrides[from] = to
+	}
+	return result, nil
+}
+
+func (d *overrideDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+
+	// case 1: unix socket target
+	if strings.HasSuffix(host, unixHostSuffix) {
+		socketPath, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+		if nil != err {
+			return nil, fmt.Errorf("invalid unix socket host '%s'", host)
+		}
+		return d.dialer.DialContext(ctx, "unix", string(socketPath))
+	}
+
+	// case 2: overridden host, host:port override is prior to host override.
+	to, ok := d.overrides[strings.ToLower(addr)]
+	if !ok {
+		to, ok = d.overrides[strings.ToLower(host)]
+	}
+	if !ok {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	if strings.HasPrefix(to, unixScheme+"://") {
+		return d.dialer.DialContext(ctx, "unix", strings.TrimPrefix(to, unixScheme+"://"))
+	}
+	if _, _, err := net.SplitHostPort(to); nil != err {
+		to = net.JoinHostPort(to, port)
+	}
+	return d.dialer.DialContext(ctx, network, to)
+}
+
+func (d *overrideDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// Rewrite unix socket target to http url, socket path is dialed by overrideDialer.
+func rewriteUnixTarget(request *http.Request) {
+	if request.URL.Scheme != unixScheme {
+		return
+	}
+	socketPath, requestPath := request.URL.Path, "/"
+	if index := strings.Index(socketPath, ":"); index >= 0 {
+		socketPath, requestPath = socketPath[:index], socketPath[index+1:]
+	}
+	request.URL.Scheme = "http"
+	request.URL.Host = hex.EncodeToString([]byte(socketPath)) + unixHostSuffix
+	request.URL.Path = requestPath
+	request.URL.RawPath = ""
+	if len(request.Host) == 0 {
+		request.Host = unixHostHeader
+	}
+}
+
+// Unix socket target is never proxied.
+func skipUnixProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(request *http.Request) (*url.URL, error) {
+		if strings.HasSuffix(request.URL.Hostname(), unixHostSuffix) {
+			return nil, nil
+		}
+		return proxy(request)
+	}
+}
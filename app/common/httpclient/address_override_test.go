@@ -0,0 +1,109 @@
+package httpclient
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Server respond 'host path?query' of request.
+func echoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	})
+}
+
+func doGet(t *testing.T, client *HttpClient, url string) string {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	res, err := client.Do(request)
+	if nil != err {
+		t.Fatalf("request '%s' fail, cause: %v", url, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestHostOverride(t *testing.T) {
+	server := httptest.NewServer(echoHandler())
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	cases := []struct {
+		name      string
+		overrides map[string]string
+		url       string
+		expect    string
+	}{
+		{"host and port", map[string]string{"staging.example.com:8080": server.Listener.Addr().String()},
+			"http://staging.example.com:8080/users?id=1", "staging.example.com:8080 /users?id=1"},
+		{"host keep original port", map[string]string{"API.local": "127.0.0.1"},
+			"http://api.local:" + port + "/", "api.local:" + port + " /"},
+		{"host and port prior to host", map[string]string{"api.local:8080": server.Listener.Addr().String(), "api.local": "127.0.0.2"},
+			"http://api.local:8080/", "api.local:8080 /"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := NewHttpClient(&HttpRequestConfig{HostOverrides: c.overrides})
+			if nil != err {
+				t.Fatalf("new http client fail, cause: %v", err)
+			}
+			if actual := doGet(t, client, c.url); actual != c.expect {
+				t.Fatalf("expect '%s', actual '%s'", c.expect, actual)
+			}
+		})
+	}
+}
+
+func TestInvalidHostOverride(t *testing.T) {
+	for _, overrides := range []map[string]string{{"api.local": " "}, {" ": "127.0.0.1"}, {"api.local": "unix://"}} {
+		if _, err := NewHttpClient(&HttpRequestConfig{HostOverrides: overrides}); nil == err {
+			t.Fatalf("host override %v expect fail", overrides)
+		}
+	}
+}
+
+func TestUnixSocketTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix-target-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if nil != err {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(echoHandler())
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	client, err := NewHttpClient(&HttpRequestConfig{HostOverrides: map[string]string{"api.local": "unix://" + socketPath}})
+	if nil != err {
+		t.Fatalf("new http client fail, cause: %v", err)
+	}
+	cases := []struct {
+		name   string
+		url    string
+		expect string
+	}{
+		{"unix target url", "unix://" + socketPath + ":/users?id=1", "localhost /users?id=1"},
+		{"unix target without request path", "unix://" + socketPath, "localhost /"},
+		{"host overridden to unix socket", "http://api.local/users", "api.local /users"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := doGet(t, client, c.url); actual != c.expect {
+				t.Fatalf("expect '%s', actual '%s'", c.expect, actual)
+			}
+		})
+	}
+}
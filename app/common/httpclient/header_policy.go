@@ -0,0 +1,85 @@
+package httpclient
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header policy, original headers of replayed request are preserved by default.
+const (
+	HeaderPolicyPreserve     = "preserve"       // keep original header, earlier policies of it are dropped, value is ignored
+	HeaderPolicyOverride     = "override"       // always set value, remove header if value is empty
+	HeaderPolicyAddIfMissing = "add_if_missing" // set value only if original request has no such header
+)
+
+type HeaderPolicy struct {
+	Name   string `yaml:"name"`
+	Value  string `yaml:"value"`
+	Policy string `yaml:"policy"` // preserve, override, add_if_missing, default add_if_missing
+}
+
+// Header policies of config, legacy user agent and origin host are added only if missing,
+// they're not applied if header is preserved.
+func newHeaderPolicies(config *HttpRequestConfig) ([]*HeaderPolicy, error) {
+	var policies []*HeaderPolicy
+	if len(strings.TrimSpace(config.UA)) > 0 {
+		policies = append(policies, &HeaderPolicy{Name: "User-Agent", Value: config.UA, Policy: HeaderPolicyAddIfMissing})
+	}
+	if len(strings.TrimSpace(config.OriginHost)) > 0 {
+		policies = append(policies, &HeaderPolicy{Name: "Referer", Value: config.OriginHost, Policy: HeaderPolicyAddIfMissing})
+	}
+
+	for _, header := range config.Headers {
+		if nil == header || len(strings.TrimSpace(header.Name)) == 0 {
+			return nil, fmt.Errorf("header name is empty")
+		}
+		policy := &HeaderPolicy{Name: http.CanonicalHeaderKey(strings.TrimSpace(header.Name)), Value: header.Value, Policy: header.Policy}
+		switch policy.Policy {
+		case "":
+			policy.Policy = HeaderPolicyAddIfMissing
+		case HeaderPolicyPreserve, HeaderPolicyOverride, HeaderPolicyAddIfMissing:
+		default:
+			return nil, fmt.Errorf("invalid policy '%s' of header '%s'", header.Policy, header.Name)
+		}
+		if policy.Policy == HeaderPolicyPreserve {
+			policies = dropHeaderPolicies(policies, policy.Name)
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// Drop policies of header, such as legacy user agent policy of preserved header.
+func dropHeaderPolicies(policies []*HeaderPolicy, name string) []*HeaderPolicy {
+	result := policies[:0]
+	for _, policy := range policies {
+		if policy.Name != name {
+			result = append(result, policy)
+		}
+	}
+	return result
+}
+
+// Apply policies in order, later policy of same header wins.
+func applyHeaderPolicies(header http.Header, policies []*HeaderPolicy) {
+	for _, policy := range policies {
+		switch policy.Policy {
+		case HeaderPolicyOverride:
+			if len(policy.Value) == 0 {
+				header.Del(policy.Name)
+			} else {
+				header.Set(policy.Name, policy.Value)
+			}
+		case HeaderPolicyAddIfMissing:
+			if len(header.Get(policy.Name)) == 0 {
+				header.Set(policy.Name, policy.Value)
+			}
+		case HeaderPolicyPreserve:
+			// http client send default user agent if it's missing, empty value send no user agent.
+			if _, ok := header[policy.Name]; !ok && policy.Name == "User-Agent" {
+				header[policy.Name] = []string{""}
+			}
+		}
+	}
+}
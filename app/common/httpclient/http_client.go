@@ -1,38 +1,103 @@
 package httpclient
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
-	"golang.org/x/net/publicsuffix"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
-	"strings"
 	"time"
 )
 
-const defaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/77.0.3865.120 Safari/537.36"
 const defaultTimeoutMs = 1000
 
+// Default retry policy, backoff is doubled on each retry and capped by max backoff.
+const (
+	defaultRetryBackoffMs    = 100
+	defaultRetryMaxBackoffMs = 2000
+)
+
+// Default connection pool settings.
+const (
+	defaultMaxIdleConns          = 1024
+	defaultMaxIdleConnsPerHost   = 256
+	defaultIdleConnTimeoutMs     = 90 * 1000
+	defaultKeepAliveMs           = 30 * 1000
+	defaultTLSHandshakeTimeoutMs = 10 * 1000
+	defaultMaxRedirects          = 10
+)
+
+var defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
 type HttpRequestConfig struct {
-	TimeoutMs       int  `yaml:"timeout_ms"`
+	TimeoutMs       int  `yaml:"timeout_ms"` // timeout of each attempt
 	MaxRetry        int  `yaml:"max_retry"`
 	IsAllowRedirect bool `yaml:"is_allow_redirect"`
 	MaxRedirects    int  `yaml:"max_redirects"`
 
-	UA         string `yaml:"user_agent"`
-	OriginHost string `yaml:"origin_host"`
+	UA         string `yaml:"user_agent"`  // add User-Agent if original request has not
+	OriginHost string `yaml:"origin_host"` // add Referer if original request has not
+
+	// policy of replayed request headers, original headers are preserved by default.
+	Headers []*HeaderPolicy `yaml:"headers"`
 
 	// http proxy, basic auth, See: https://en.wikipedia.org/wiki/Basic_access_authentication
 	ProxyUrl      string `yaml:"proxy_url"`
 	ProxyUsername string `yaml:"proxy_username"`
 	ProxyPassword string `yaml:"proxy_password"`
+
+	// static host mapping, such as: 'staging.example.com: 10.0.0.8:8080', 'api.local:80: unix:///var/run/api.sock'.
+	// target url of unix socket is supported too, such as: 'unix:///var/run/api.sock:/users?id=1'.
+	HostOverrides map[string]string `yaml:"host_overrides"`
+
+	// retry on connection error and retry status codes, with exponential backoff and jitter.
+	RetryStatusCodes  []int `yaml:"retry_status_codes"`   // default 502, 503, 504
+	RetryBackoffMs    int   `yaml:"retry_backoff_ms"`     // backoff of first retry, default 100ms
+	RetryMaxBackoffMs int   `yaml:"retry_max_backoff_ms"` // default 2s
+	DeadlineMs        int   `yaml:"deadline_ms"`          // overall deadline of request include retries, no deadline if not set
+
+	// connection pool, keep enough idle connections to avoid exhausting ephemeral ports at high rate.
+	MaxIdleConns          int  `yaml:"max_idle_conns"`           // default 1024
+	MaxIdleConnsPerHost   int  `yaml:"max_idle_conns_per_host"`  // default 256
+	MaxConnsPerHost       int  `yaml:"max_conns_per_host"`       // no limit if not set
+	IdleConnTimeoutMs     int  `yaml:"idle_conn_timeout_ms"`     // default 90s
+	KeepAliveMs           int  `yaml:"keep_alive_ms"`            // tcp keep-alive period, default 30s, negative disable it
+	DialTimeoutMs         int  `yaml:"dial_timeout_ms"`          // default timeout_ms
+	TLSHandshakeTimeoutMs int  `yaml:"tls_handshake_timeout_ms"` // default 10s
+	DisableKeepAlives     bool `yaml:"disable_keep_alives"`      // disable http keep-alive, new connection per request
+	DisableCompression    bool `yaml:"disable_compression"`      // not send 'Accept-Encoding: gzip'
+
+	// tls of replay target, such as staging environment with internal PKI.
+	TlsCaFile             string `yaml:"tls_ca_file"`              // PEM CA bundle, trusted with system CAs
+	TlsCertFile           string `yaml:"tls_cert_file"`            // client certificate of mTLS target
+	TlsKeyFile            string `yaml:"tls_key_file"`             // client private key of mTLS target
+	TlsServerName         string `yaml:"tls_server_name"`          // override SNI and verified host name
+	TlsMinVersion         string `yaml:"tls_min_version"`          // 1.0, 1.1, 1.2, 1.3
+	TlsInsecureSkipVerify bool   `yaml:"tls_insecure_skip_verify"` // not verify target certificate, test only
+
+	// cookies of replayed requests, Set-Cookie of target only update jar of same session.
+	SessionKey  string `yaml:"session_key"`  // shared, client_ip, connection, cookie:{name}, default client_ip
+	MaxSessions int    `yaml:"max_sessions"` // least recently used session is evicted, default 10000
+
+	// http2 support
+	HTTP2 bool `yaml:"http2"` // negotiate http2 by tls alpn for https target
+	H2c   bool `yaml:"h2c"`   // http2 over cleartext tcp with prior knowledge for http target, not support proxy
 }
 
 type HttpClient struct {
-	config     *HttpRequestConfig
-	httpClient *http.Client
+	config         *HttpRequestConfig
+	headerPolicies []*HeaderPolicy
+	sessionJars    *sessionJars
+	httpClient     *http.Client
 }
 
 func NewHttpClient(config *HttpRequestConfig) (*HttpClient, error) {
@@ -40,10 +105,40 @@ func NewHttpClient(config *HttpRequestConfig) (*HttpClient, error) {
 		return nil, errors.New("param is empty")
 	}
 
-	// step 1: set proxy
-	var transport *http.Transport
-	proxyUrlStr := config.ProxyUrl
+	timeout := config.TimeoutMs
+	if timeout == 0 {
+		timeout = defaultTimeoutMs
+	}
+
+	// step 1: build transport with connection pool settings
+	dialer, err := newOverrideDialer(&net.Dialer{
+		Timeout:   msOrDefault(config.DialTimeoutMs, timeout),
+		KeepAlive: msOrDefault(config.KeepAliveMs, defaultKeepAliveMs),
+	}, config.HostOverrides)
+	if nil != err {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          intOrDefault(config.MaxIdleConns, defaultMaxIdleConns),
+		MaxIdleConnsPerHost:   intOrDefault(config.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       msOrDefault(config.IdleConnTimeoutMs, defaultIdleConnTimeoutMs),
+		TLSHandshakeTimeout:   msOrDefault(config.TLSHandshakeTimeoutMs, defaultTLSHandshakeTimeoutMs),
+		ExpectContinueTimeout: time.Second,
+		DisableKeepAlives:     config.DisableKeepAlives,
+		DisableCompression:    config.DisableCompression,
+	}
 
+	tlsConfig, err := newTLSConfig(config)
+	if nil != err {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	// step 2: set proxy
+	proxyUrlStr := config.ProxyUrl
 	if len(proxyUrlStr) > 0 {
 		parseUrl, err := url.Parse(proxyUrlStr)
 		if nil != err {
@@ -54,53 +149,207 @@ func NewHttpClient(config *HttpRequestConfig) (*HttpClient, error) {
 		auth := config.ProxyUsername + ":" + config.ProxyPassword
 		proxyAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
 
-		transport = &http.Transport{
-			Proxy: http.ProxyURL(parseUrl),
-			ProxyConnectHeader: http.Header{
-				"Proxy-Authorization": {proxyAuth},
+		transport.Proxy = http.ProxyURL(parseUrl)
+		transport.ProxyConnectHeader = http.Header{
+			"Proxy-Authorization": {proxyAuth},
+		}
+	}
+
+	transport.Proxy = skipUnixProxy(transport.Proxy)
+
+	// step 3: set http2
+	var roundTripper http.RoundTripper = transport
+	if config.H2c {
+		if len(proxyUrlStr) > 0 {
+			return nil, errors.New("h2c not support proxy")
+		}
+		roundTripper = &http2.Transport{
+			AllowHTTP:          true,
+			DisableCompression: config.DisableCompression,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
 			},
 		}
+	} else if config.HTTP2 {
+		if err := http2.ConfigureTransport(transport); nil != err {
+			return nil, err
+		}
 	}
 
-	// step 2: set cookie
-	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
-	if nil != err {
+	// step 4: build http client, cookies are managed by session jars, not client jar.
+	if len(config.SessionKey) == 0 {
+		config.SessionKey = SessionKeyClientIp
+	}
+	if err := checkSessionKey(config.SessionKey); nil != err {
 		return nil, err
 	}
 
-	// step 3: build http client
-	timeout := config.TimeoutMs
-	if timeout == 0 {
-		timeout = defaultTimeoutMs
+	if len(config.RetryStatusCodes) == 0 {
+		config.RetryStatusCodes = defaultRetryStatusCodes
 	}
-	httpClient := &http.Client{
-		Timeout: time.Duration(timeout) * time.Millisecond,
-		Jar:     jar,
+	if config.RetryBackoffMs <= 0 {
+		config.RetryBackoffMs = defaultRetryBackoffMs
 	}
-	if nil != transport {
-		// if transport is nil, use default transport.
-		httpClient.Transport = transport
+	if config.RetryMaxBackoffMs <= 0 {
+		config.RetryMaxBackoffMs = defaultRetryMaxBackoffMs
 	}
-
-	if len(strings.TrimSpace(config.UA)) == 0 {
-		config.UA = defaultUserAgent
+	headerPolicies, err := newHeaderPolicies(config)
+	if nil != err {
+		return nil, err
+	}
+	hc := &HttpClient{
+		config:         config,
+		headerPolicies: headerPolicies,
+		sessionJars:    newSessionJars(config.MaxSessions),
+	}
+	hc.httpClient = &http.Client{
+		Transport:     roundTripper,
+		Timeout:       time.Duration(timeout) * time.Millisecond,
+		CheckRedirect: hc.checkRedirect,
 	}
-	return &HttpClient{
-		config:     config,
-		httpClient: httpClient,
-	}, nil
+	return hc, nil
 }
 
 func (hc *HttpClient) Do(request *http.Request) (*http.Response, error) {
+	res, _, err := hc.DoWithRetries(request)
+	return res, err
+}
+
+// Do request with retries, return retry count as well. request body is buffered to re-send it.
+func (hc *HttpClient) DoWithRetries(request *http.Request) (*http.Response, int, error) {
 	if nil == request {
-		return nil, errors.New("param is empty")
+		return nil, 0, errors.New("param is empty")
 	}
 
-	request.Header.Set("User-Agent", hc.config.UA)
-	request.Header.Set("Referer", hc.config.OriginHost)
+	applyHeaderPolicies(request.Header, hc.headerPolicies)
+	rewriteUnixTarget(request)
 
-	// TODO: retry
-	res, err := hc.httpClient.Do(request)
+	// step 1: buffer body, send it with content length, GetBody rewind it for retries and 307/308 redirects.
+	if nil != request.Body && request.Body != http.NoBody {
+		body, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if nil != err {
+			return nil, 0, err
+		}
+		request.ContentLength = int64(len(body))
+		request.GetBody = func() (io.ReadCloser, error) {
+			if len(body) == 0 {
+				return http.NoBody, nil
+			}
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
 
-	return res, err
+	// step 2: overall deadline, it's canceled after response body closed.
+	ctx, cancel := request.Context(), context.CancelFunc(func() {})
+	if hc.config.DeadlineMs > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(hc.config.DeadlineMs)*time.Millisecond)
+	}
+	request = request.WithContext(ctx)
+
+	// step 3: do request until success or no retry left.
+	for retries := 0; ; retries++ {
+		if nil != request.GetBody {
+			request.Body, _ = request.GetBody()
+		}
+		hc.addSessionCookies(request)
+		res, err := hc.httpClient.Do(request)
+		if nil == err {
+			hc.saveSessionCookies(request, res)
+		}
+		if retries >= hc.config.MaxRetry || !hc.isRetry(res, err) || !hc.backoff(ctx, retries) {
+			if nil != err {
+				cancel()
+				return nil, retries, err
+			}
+			res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+			return res, retries, nil
+		}
+		if nil != res {
+			// drain body, so connection can be reused.
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+	}
+}
+
+// Follow redirect only if it's allowed, return redirect response directly if not.
+func (hc *HttpClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !hc.config.IsAllowRedirect {
+		return http.ErrUseLastResponse
+	}
+	maxRedirects := intOrDefault(hc.config.MaxRedirects, defaultMaxRedirects)
+	if len(via) > maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	// cookies set by redirect response are sent with redirect request.
+	hc.saveSessionCookies(req, req.Response)
+	hc.addSessionCookies(req)
+	return nil
+}
+
+func intOrDefault(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func msOrDefault(valueMs, defaultValueMs int) time.Duration {
+	return time.Duration(intOrDefault(valueMs, defaultValueMs)) * time.Millisecond
+}
+
+// Retry on connection error and retry status codes.
+func (hc *HttpClient) isRetry(res *http.Response, err error) bool {
+	if nil != err {
+		return true
+	}
+	for _, code := range hc.config.RetryStatusCodes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait exponential backoff with jitter, return false if deadline exceeded before next retry.
+func (hc *HttpClient) backoff(ctx context.Context, retries int) bool {
+	backoff := hc.backoffDuration(retries)
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+		return false
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Backoff is doubled on each retry until max backoff, so large retry count never overflow.
+// jitter in [backoff/2, backoff], avoid all workers retry at same time.
+func (hc *HttpClient) backoffDuration(retries int) time.Duration {
+	backoff := time.Duration(hc.config.RetryBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(hc.config.RetryMaxBackoffMs) * time.Millisecond
+	for i := 0; i < retries && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Cancel request context after response body closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
 }
@@ -0,0 +1,242 @@
+package httpclient
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server respond status codes in order, last status code is repeated, bodies of requests are recorded.
+type statusServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func newStatusServer(statuses ...int) *statusServer {
+	server := &statusServer{statuses: statuses}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		server.mutex.Lock()
+		index := len(server.bodies)
+		if index >= len(server.statuses) {
+			index = len(server.statuses) - 1
+		}
+		server.bodies = append(server.bodies, string(body))
+		server.mutex.Unlock()
+		w.WriteHeader(server.statuses[index])
+	}))
+	return server
+}
+
+func (server *statusServer) requestBodies() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.bodies...)
+}
+
+func TestRetries(t *testing.T) {
+	cases := []struct {
+		name          string
+		statuses      []int
+		maxRetry      int
+		retryCodes    []int
+		expectStatus  int
+		expectRetries int
+	}{
+		{"success without retry", []int{200}, 3, nil, 200, 0},
+		{"retry until success", []int{503, 502, 200}, 3, nil, 200, 2},
+		{"no retry left", []int{503}, 2, nil, 503, 2},
+		{"not retry status", []int{500, 200}, 3, nil, 500, 0},
+		{"custom retry status", []int{500, 200}, 3, []int{500}, 200, 1},
+		{"retry disabled", []int{503, 200}, 0, nil, 503, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := newStatusServer(c.statuses...)
+			defer server.Close()
+			client, err := NewHttpClient(&HttpRequestConfig{MaxRetry: c.maxRetry, RetryStatusCodes: c.retryCodes, RetryBackoffMs: 1, RetryMaxBackoffMs: 2})
+			if nil != err {
+				t.Fatalf("new http client fail, cause: %v", err)
+			}
+			request, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("payload"))
+			res, retries, err := client.DoWithRetries(request)
+			if nil != err {
+				t.Fatalf("request fail, cause: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != c.expectStatus || retries != c.expectRetries {
+				t.Fatalf("expect status %d with %d retries, actual %d with %d retries", c.expectStatus, c.expectRetries, res.StatusCode, retries)
+			}
+			// body is re-sent on each retry.
+			for i, body := range server.requestBodies() {
+				if body != "payload" {
+					t.Fatalf("body of attempt %d expect 'payload', actual '%s'", i, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	server := newStatusServer(200)
+	addr := server.URL
+	server.Close()
+
+	client, err := NewHttpClient(&HttpRequestConfig{MaxRetry: 2, RetryBackoffMs: 1, RetryMaxBackoffMs: 2})
+	if nil != err {
+		t.Fatalf("new http client fail, cause: %v", err)
+	}
+	request, _ := http.NewRequest(http.MethodGet, addr, nil)
+	if _, retries, err := client.DoWithRetries(request); nil == err || retries != 2 {
+		t.Fatalf("expect error after 2 retries, actual %d retries, error: %v", retries, err)
+	}
+}
+
+// Retry is stopped if next backoff exceeds deadline, last attempt may be canceled by deadline.
+func TestRetryDeadline(t *testing.T) {
+	server := newStatusServer(503)
+	defer server.Close()
+
+	client, err := NewHttpClient(&HttpRequestConfig{MaxRetry: 100, RetryBackoffMs: 40, RetryMaxBackoffMs: 40, DeadlineMs: 100})
+	if nil != err {
+		t.Fatalf("new http client fail, cause: %v", err)
+	}
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	res, _, err := client.DoWithRetries(request)
+	if nil == err {
+		res.Body.Close()
+		if res.StatusCode != 503 {
+			t.Fatalf("status expect 503, actual %d", res.StatusCode)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("deadline exceeded, elapsed %v", elapsed)
+	}
+	if attempts := len(server.requestBodies()); attempts < 2 || attempts > 10 {
+		t.Fatalf("expect few attempts before deadline, actual %d", attempts)
+	}
+}
+
+// Retried and redirected requests are sent with content length, not chunked.
+func TestRetryContentLength(t *testing.T) {
+	var mutex sync.Mutex
+	var attempts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/target" {
+			http.Redirect(w, r, "/target", http.StatusTemporaryRedirect)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		attempts = append(attempts, fmt.Sprintf("%d %v %s", r.ContentLength, r.TransferEncoding, body))
+		status := http.StatusOK
+		if len(attempts) == 1 {
+			status = http.StatusServiceUnavailable
+		}
+		mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client, err := NewHttpClient(&HttpRequestConfig{IsAllowRedirect: true, MaxRetry: 1, RetryBackoffMs: 1, RetryMaxBackoffMs: 2})
+	if nil != err {
+		t.Fatalf("new http client fail, cause: %v", err)
+	}
+	request, _ := http.NewRequest(http.MethodPost, server.URL, ioutil.NopCloser(strings.NewReader("payload")))
+	res, retries, err := client.DoWithRetries(request)
+	if nil != err {
+		t.Fatalf("request fail, cause: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || retries != 1 {
+		t.Fatalf("expect status 200 with 1 retry, actual %d with %d retries", res.StatusCode, retries)
+	}
+	expect := []string{"7 [] payload", "7 [] payload"}
+	if fmt.Sprint(attempts) != fmt.Sprint(expect) {
+		t.Fatalf("attempts expect %v, actual %v", expect, attempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	hc := &HttpClient{config: &HttpRequestConfig{RetryBackoffMs: 10, RetryMaxBackoffMs: 50}}
+	cases := []struct {
+		retries int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{0, 5 * time.Millisecond, 10 * time.Millisecond},
+		{1, 10 * time.Millisecond, 20 * time.Millisecond},
+		{3, 25 * time.Millisecond, 50 * time.Millisecond},
+		{100, 25 * time.Millisecond, 50 * time.Millisecond},
+	}
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			if backoff := hc.backoffDuration(c.retries); backoff < c.min || backoff > c.max {
+				t.Fatalf("backoff of retry %d expect in [%v, %v], actual %v", c.retries, c.min, c.max, backoff)
+			}
+		}
+	}
+}
+
+// Server redirect '/redirect/{n}' to '/redirect/{n-1}', '/redirect/0' respond 200.
+func newRedirectServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if n <= 0 {
+			w.Write([]byte("done"))
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(n-1), http.StatusFound)
+	}))
+}
+
+func TestRedirect(t *testing.T) {
+	cases := []struct {
+		name         string
+		allow        bool
+		maxRedirects int
+		path         string
+		expectStatus int // 0 means error
+	}{
+		{"redirect not allowed return redirect response", false, 0, "/redirect/1", http.StatusFound},
+		{"redirect followed", true, 0, "/redirect/3", http.StatusOK},
+		{"redirects within max", true, 2, "/redirect/1", http.StatusOK},
+		{"redirects equal to max", true, 2, "/redirect/2", http.StatusOK},
+		{"redirects exceed max", true, 2, "/redirect/3", 0},
+	}
+	server := newRedirectServer()
+	defer server.Close()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := NewHttpClient(&HttpRequestConfig{IsAllowRedirect: c.allow, MaxRedirects: c.maxRedirects})
+			if nil != err {
+				t.Fatalf("new http client fail, cause: %v", err)
+			}
+			request, _ := http.NewRequest(http.MethodGet, server.URL+c.path, nil)
+			res, err := client.Do(request)
+			if c.expectStatus == 0 {
+				if nil == err {
+					res.Body.Close()
+					t.Fatalf("expect fail, actual status %d", res.StatusCode)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("request fail, cause: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != c.expectStatus {
+				t.Fatalf("status expect %d, actual %d", c.expectStatus, res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package httpclient
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"golang.org/x/net/publicsuffix"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+)
+
+// Session key, decide which replayed requests share cookie jar.
+const (
+	SessionKeyShared       = "shared"     // all requests share one jar
+	SessionKeyClientIp     = "client_ip"  // requests of same original client ip share jar, default
+	SessionKeyConnection   = "connection" // requests of same original connection share jar
+	SessionKeyCookiePrefix = "cookie:"    // requests with same original cookie value share jar, such as: 'cookie:JSESSIONID'
+)
+
+const defaultMaxSessions = 10000
+
+type sessionContextKey struct{}
+
+// Bind request to replay session, cookies of session jar are sent with request and updated by response.
+func WithSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+func sessionOf(ctx context.Context) string {
+	session, _ := ctx.Value(sessionContextKey{}).(string)
+	return session
+}
+
+func checkSessionKey(sessionKey string) error {
+	switch {
+	case sessionKey == SessionKeyShared, sessionKey == SessionKeyClientIp, sessionKey == SessionKeyConnection:
+		return nil
+	case strings.HasPrefix(sessionKey, SessionKeyCookiePrefix) && len(sessionKey) > len(SessionKeyCookiePrefix):
+		return nil
+	}
+	return fmt.Errorf("invalid session key '%s', support shared, client_ip, connection, cookie:{name}", sessionKey)
+}
+
+// Session of original request, fallback to client ip if session cookie not found.
+func (hc *HttpClient) SessionOf(request *http.Request, clientIp, connId string) string {
+	switch sessionKey := hc.config.SessionKey; {
+	case sessionKey == SessionKeyShared:
+		return ""
+	case sessionKey == SessionKeyConnection:
+		return "conn:" + connId
+	case strings.HasPrefix(sessionKey, SessionKeyCookiePrefix):
+		if cookie, err := request.Cookie(strings.TrimPrefix(sessionKey, SessionKeyCookiePrefix)); nil == err {
+			return "cookie:" + cookie.Value
+		}
+	}
+	return "ip:" + clientIp
+}
+
+// Cookies of session jar override original cookies with same name, original session is invalid on replay target.
+func (hc *HttpClient) addSessionCookies(request *http.Request) {
+	jarCookies := hc.sessionJars.get(sessionOf(request.Context())).Cookies(request.URL)
+	if len(jarCookies) == 0 {
+		return
+	}
+	names := make(map[string]bool, len(jarCookies))
+	cookies := make([]string, 0, len(jarCookies))
+	for _, cookie := range jarCookies {
+		names[cookie.Name] = true
+		cookies = append(cookies, (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String())
+	}
+	for _, cookie := range request.Cookies() {
+		if !names[cookie.Name] {
+			cookies = append(cookies, (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String())
+		}
+	}
+	request.Header.Set("Cookie", strings.Join(cookies, "; "))
+}
+
+// Save Set-Cookie of response to jar of request session only.
+func (hc *HttpClient) saveSessionCookies(request *http.Request, response *http.Response) {
+	if cookies := response.Cookies(); len(cookies) > 0 {
+		hc.sessionJars.get(sessionOf(request.Context())).SetCookies(response.Request.URL, cookies)
+	}
+}
+
+// Cookie jars of sessions, least recently used session is evicted if exceed max sessions.
+type sessionJars struct {
+	mutex       sync.Mutex
+	maxSessions int
+	jars        map[string]*list.Element
+	lru         *list.List // front is most recently used
+}
+
+type sessionJar struct {
+	session string
+	jar     *cookiejar.Jar
+}
+
+func newSessionJars(maxSessions int) *sessionJars {
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxSessions
+	}
+	return &sessionJars{
+		maxSessions: maxSessions,
+		jars:        make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+func (s *sessionJars) get(session string) *cookiejar.Jar {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if element, ok := s.jars[session]; ok {
+		s.lru.MoveToFront(element)
+		return element.Value.(*sessionJar).jar
+	}
+
+	// error is always nil, See: cookiejar.New
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	s.jars[session] = s.lru.PushFront(&sessionJar{session: session, jar: jar})
+	if s.lru.Len() > s.maxSessions {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.jars, oldest.Value.(*sessionJar).session)
+	}
+	return jar
+}
@@ -0,0 +1,72 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Build tls config of replay target, return nil if nothing configured, so default tls config is used.
+func newTLSConfig(config *HttpRequestConfig) (*tls.Config, error) {
+	if len(config.TlsCaFile) == 0 && len(config.TlsCertFile) == 0 && len(config.TlsKeyFile) == 0 &&
+		len(config.TlsServerName) == 0 && len(config.TlsMinVersion) == 0 && !config.TlsInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         config.TlsServerName,
+		InsecureSkipVerify: config.TlsInsecureSkipVerify,
+	}
+
+	// case 1: CA bundle, trust internal PKI as well as system CAs.
+	if len(config.TlsCaFile) > 0 {
+		pem, err := ioutil.ReadFile(config.TlsCaFile)
+		if nil != err {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if nil != err || nil == pool {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca file '%s'", config.TlsCaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// case 2: client certificate of mTLS
+	if len(config.TlsCertFile) > 0 || len(config.TlsKeyFile) > 0 {
+		if len(config.TlsCertFile) == 0 || len(config.TlsKeyFile) == 0 {
+			return nil, errors.New("tls cert file and key file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+		if nil != err {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// case 3: min version
+	if len(config.TlsMinVersion) > 0 {
+		version, ok := tlsVersions[strings.TrimSpace(config.TlsMinVersion)]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls min version '%s', support 1.0, 1.1, 1.2, 1.3", config.TlsMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if config.TlsInsecureSkipVerify {
+		log.Println("[Http-client] tls certificate verification of replay target is disabled.")
+	}
+	return tlsConfig, nil
+}
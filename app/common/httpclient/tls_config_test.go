@@ -0,0 +1,139 @@
+package httpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePem(t *testing.T, path, blockType string, data []byte) string {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); nil != err {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Self-signed client certificate, return cert file and key file.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "replay-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return writePem(t, filepath.Join(dir, "client.crt"), "CERTIFICATE", der), writePem(t, filepath.Join(dir, "client.key"), "EC PRIVATE KEY", keyDer)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-config-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	emptyCa := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(emptyCa, []byte("no certificate"), 0600)
+
+	cases := []struct {
+		name       string
+		config     *HttpRequestConfig
+		expectNil  bool
+		expectFail bool
+	}{
+		{"nothing configured use default", &HttpRequestConfig{}, true, false},
+		{"min version", &HttpRequestConfig{TlsMinVersion: "1.2"}, false, false},
+		{"invalid min version", &HttpRequestConfig{TlsMinVersion: "1.4"}, false, true},
+		{"cert without key", &HttpRequestConfig{TlsCertFile: filepath.Join(dir, "client.crt")}, false, true},
+		{"ca file not found", &HttpRequestConfig{TlsCaFile: filepath.Join(dir, "missing.pem")}, false, true},
+		{"no certificate in ca file", &HttpRequestConfig{TlsCaFile: emptyCa}, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(c.config)
+			if c.expectFail {
+				if nil == err {
+					t.Fatal("expect fail")
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("new tls config fail, cause: %v", err)
+			}
+			if (nil == tlsConfig) != c.expectNil {
+				t.Fatalf("tls config expect nil %v, actual %v", c.expectNil, tlsConfig)
+			}
+		})
+	}
+	if tlsConfig, _ := newTLSConfig(&HttpRequestConfig{TlsMinVersion: "1.2"}); tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("min version expect tls 1.2, actual %x", tlsConfig.MinVersion)
+	}
+}
+
+func TestTLSTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-target-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// target require client certificate, it's certificate is signed by test CA of httptest.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	caFile := writePem(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", server.Certificate().Raw)
+	certFile, keyFile := writeClientCert(t, dir)
+
+	cases := []struct {
+		name       string
+		config     *HttpRequestConfig
+		expectFail bool
+	}{
+		{"trusted by ca file", &HttpRequestConfig{TlsCaFile: caFile, TlsCertFile: certFile, TlsKeyFile: keyFile}, false},
+		{"server name in certificate", &HttpRequestConfig{TlsCaFile: caFile, TlsCertFile: certFile, TlsKeyFile: keyFile, TlsServerName: "example.com"}, false},
+		{"server name not in certificate", &HttpRequestConfig{TlsCaFile: caFile, TlsCertFile: certFile, TlsKeyFile: keyFile, TlsServerName: "other.test"}, true},
+		{"unknown authority", &HttpRequestConfig{TlsCertFile: certFile, TlsKeyFile: keyFile}, true},
+		{"skip verify", &HttpRequestConfig{TlsInsecureSkipVerify: true, TlsCertFile: certFile, TlsKeyFile: keyFile}, false},
+		{"no client certificate", &HttpRequestConfig{TlsCaFile: caFile}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := NewHttpClient(c.config)
+			if nil != err {
+				t.Fatalf("new http client fail, cause: %v", err)
+			}
+			request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			res, err := client.Do(request)
+			if nil == err {
+				res.Body.Close()
+			}
+			if (nil != err) != c.expectFail {
+				t.Fatalf("expect fail %v, actual error: %v", c.expectFail, err)
+			}
+		})
+	}
+}
@@ -6,17 +6,23 @@ import (
 )
 
 const (
-	OK          = 10200
-	BAD_REQUEST = 10400
-	NOT_FOUND   = 10404
-	CONFLICT    = 10409
+	OK                  = 10200
+	BAD_REQUEST         = 10400
+	UNAUTHORIZED        = 10401
+	NOT_FOUND           = 10404
+	CONFLICT            = 10409
+	TOO_MANY_REQUESTS   = 10429
+	SERVICE_UNAVAILABLE = 10503
 )
 
 var statusText = map[int]string{
-	OK:          "ok",
-	BAD_REQUEST: "bad request.",
-	NOT_FOUND:   "not found.",
-	CONFLICT:    "conflict",
+	OK:                  "ok",
+	BAD_REQUEST:         "bad request.",
+	UNAUTHORIZED:        "unauthorized.",
+	NOT_FOUND:           "not found.",
+	CONFLICT:            "conflict",
+	TOO_MANY_REQUESTS:   "too many requests.",
+	SERVICE_UNAVAILABLE: "service unavailable.",
 }
 
 func responseMsgMapping(code int) string {
@@ -42,8 +48,21 @@ func WriteJsonData(res http.ResponseWriter, code int, data interface{}) {
 }
 
 func WriteJsonRawData(res http.ResponseWriter, code int, msg string, data interface{}) {
+	WriteJsonStatusRawData(res, http.StatusOK, code, msg, data)
+}
+
+// Write json with special http status code, default is 200.
+func WriteJsonStatus(res http.ResponseWriter, status int, code int) {
+	WriteJsonStatusRawData(res, status, code, responseMsgMapping(code), nil)
+}
+
+func WriteJsonStatusData(res http.ResponseWriter, status int, code int, data interface{}) {
+	WriteJsonStatusRawData(res, status, code, responseMsgMapping(code), data)
+}
+
+func WriteJsonStatusRawData(res http.ResponseWriter, status int, code int, msg string, data interface{}) {
 	res.Header().Set("Content-Type", "application/json; charset=utf-8")
-	res.WriteHeader(http.StatusOK)
+	res.WriteHeader(status)
 	r := ResponseMsg{
 		Code:    code,
 		Message: msg,
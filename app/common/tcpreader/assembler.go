@@ -0,0 +1,70 @@
+package tcpreader
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/reassembly"
+	"time"
+)
+
+// Default tcp reassembly memory limit, a page is about 1900 bytes.
+const (
+	DefaultMaxBufferedPagesPerConn = 1024
+	DefaultMaxBufferedPagesTotal   = 65536
+	DefaultOutOfOrderTimeout       = 10 * time.Second
+	DefaultConnectionTimeout       = 2 * time.Minute
+)
+
+// Tcp reassembly memory limit and timeouts.
+type AssemblerOptions struct {
+	MaxBufferedPagesPerConn int
+	MaxBufferedPagesTotal   int
+	OutOfOrderTimeout       time.Duration // stop waiting lost segment
+	ConnectionTimeout       time.Duration // close connection without activity
+}
+
+// Options of assembler, non positive value is replaced by default.
+func NewAssemblerOptions(maxBufferedPagesPerConn, maxBufferedPagesTotal int, outOfOrderTimeout, connectionTimeout time.Duration) *AssemblerOptions {
+	options := &AssemblerOptions{
+		MaxBufferedPagesPerConn: maxBufferedPagesPerConn,
+		MaxBufferedPagesTotal:   maxBufferedPagesTotal,
+		OutOfOrderTimeout:       outOfOrderTimeout,
+		ConnectionTimeout:       connectionTimeout,
+	}
+	if options.MaxBufferedPagesPerConn <= 0 {
+		options.MaxBufferedPagesPerConn = DefaultMaxBufferedPagesPerConn
+	}
+	if options.MaxBufferedPagesTotal <= 0 {
+		options.MaxBufferedPagesTotal = DefaultMaxBufferedPagesTotal
+	}
+	if options.OutOfOrderTimeout <= 0 {
+		options.OutOfOrderTimeout = DefaultOutOfOrderTimeout
+	}
+	if options.ConnectionTimeout <= 0 {
+		options.ConnectionTimeout = DefaultConnectionTimeout
+	}
+	return options
+}
+
+func NewAssembler(factory reassembly.StreamFactory, options *AssemblerOptions) *reassembly.Assembler {
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(factory))
+	assembler.MaxBufferedPagesPerConnection = options.MaxBufferedPagesPerConn
+	assembler.MaxBufferedPagesTotal = options.MaxBufferedPagesTotal
+	return assembler
+}
+
+// Stop waiting out of order data after timeout, close connection which has no activity, relative to now.
+func (options *AssemblerOptions) FlushOptions(now time.Time) reassembly.FlushOptions {
+	return reassembly.FlushOptions{
+		T:  now.Add(-options.OutOfOrderTimeout),
+		TC: now.Add(-options.ConnectionTimeout),
+	}
+}
+
+// Assembler context of packet, assembler use capture timestamp of it.
+type AssemblerContext struct {
+	gopacket.CaptureInfo
+}
+
+func (ctx *AssemblerContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return ctx.CaptureInfo
+}
@@ -0,0 +1,85 @@
+package tcpreader
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// default count of reassembled chunks which not read by reader, feeder is blocked if exceed it.
+const defaultBufferedChunks = 64
+
+var ErrStreamClosed = errors.New("reader stream already closed")
+
+// ReaderStream implements io.Reader over reassembled tcp data, it's fed by reassembly.Stream,
+// similar to gopacket tcpreader but work with gopacket reassembly package.
+type ReaderStream struct {
+	mutex sync.Mutex
+
+	chunks  chan []byte
+	current []byte
+	done    chan struct{} // closed when reader stop reading
+	discard sync.Once
+	closed  bool
+}
+
+func NewReaderStream() *ReaderStream {
+	return &ReaderStream{
+		mutex:  sync.Mutex{},
+		chunks: make(chan []byte, defaultBufferedChunks),
+		done:   make(chan struct{}),
+	}
+}
+
+// Feed copy of data to reader, block if too much data is not read.
+func (r *ReaderStream) Feed(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return ErrStreamClosed
+	}
+
+	chunk := make([]byte, len(data))
+	copy(chunk, data)
+	select {
+	case r.chunks <- chunk:
+		return nil
+	case <-r.done:
+		return ErrStreamClosed
+	}
+}
+
+// Close stream, reader get io.EOF after all fed data read.
+func (r *ReaderStream) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.chunks)
+	}
+}
+
+func (r *ReaderStream) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		chunk, ok := <-r.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		r.current = chunk
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Discard all data until stream closed, reader must not be used after that.
+func (r *ReaderStream) Discard() {
+	r.discard.Do(func() {
+		close(r.done)
+	})
+	io.Copy(ioutil.Discard, r)
+}
@@ -3,6 +3,10 @@ package config
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"xtransform/app/common/balancer"
+	"xtransform/app/common/certstore"
+	"xtransform/app/common/comparison"
+	"xtransform/app/common/correlation"
 	"xtransform/app/common/httpclient"
 )
 
@@ -13,6 +17,59 @@ type AppConfig struct {
 	RawInputPluginConfig *RawInputConfig `yaml:"raw_input_plugin_config"`
 
 	TcpOutputPluginConfig string `yaml:"tcp_output_plugin_config"`
+
+	// plugins created by registered factory, include third-party plugins.
+	Inputs  []*PluginConfig `yaml:"inputs"`
+	Outputs []*PluginConfig `yaml:"outputs"`
+
+	// admin api, disabled if port is not set.
+	Admin *AdminConfig `yaml:"admin"`
+
+	// route input plugin to output plugin by plugin name, default route all inputs to all outputs.
+	Routes []*RouteConfig `yaml:"routes"`
+
+	// check config file change interval, in millisecond, default 5s, negative disable it (SIGHUP still works).
+	ReloadIntervalMs int `yaml:"reload_interval"`
+}
+
+type AdminConfig struct {
+	Addr  string `yaml:"addr"`  // bind address, default 127.0.0.1
+	Port  int    `yaml:"port"`  // bind port, separate from http input plugin
+	Token string `yaml:"token"` // required, request must carry 'Authorization: Bearer {token}'
+}
+
+type RouteConfig struct {
+	Input  string `yaml:"input"`
+	Output string `yaml:"output"`
+}
+
+// Plugin config, options is decoded by plugin factory of type.
+type PluginConfig struct {
+	Name    string                 `yaml:"name"` // unique plugin name, default plugin type name
+	Type    string                 `yaml:"type"` // registered plugin type, such as: http, raw, tcp
+	Options map[string]interface{} `yaml:"options"`
+}
+
+// Build plugin config with options of plugin own config struct.
+func NewPluginConfig(name, pluginType string, options interface{}) (*PluginConfig, error) {
+	data, err := yaml.Marshal(options)
+	if nil != err {
+		return nil, err
+	}
+	pluginConfig := &PluginConfig{Name: name, Type: pluginType}
+	if err := yaml.Unmarshal(data, &pluginConfig.Options); nil != err {
+		return nil, err
+	}
+	return pluginConfig, nil
+}
+
+// Decode options to plugin own config struct by yaml tag.
+func (c *PluginConfig) DecodeOptions(out interface{}) error {
+	data, err := yaml.Marshal(c.Options)
+	if nil != err {
+		return err
+	}
+	return yaml.Unmarshal(data, out)
 }
 
 type Option interface{}
@@ -26,9 +83,16 @@ type HttpServerConfig struct {
 	MaxHeaderBytes int    `yaml:"max_header_bytes"` // unit in byte
 
 	// ssl support
-	Ssl     bool   `yaml:"ssl"`
-	SslCert string `yaml:"ssl_cert"`
-	SslKey  string `yaml:"ssl_key"`
+	Ssl           bool                 `yaml:"ssl"`
+	SslCert       string               `yaml:"ssl_cert"`
+	SslKey        string               `yaml:"ssl_key"`
+	SslCerts      []*certstore.KeyPair `yaml:"ssl_certs"`           // extra certificates, select by SNI
+	SslClientCa   string               `yaml:"ssl_client_ca"`       // CA bundle to verify client certificate
+	SslClientAuth string               `yaml:"ssl_client_auth"`     // none, request, require, verify_if_given, require_and_verify
+	SslReloadMs   int                  `yaml:"ssl_reload_interval"` // check certificate file change interval, in millisecond, default 10s
+
+	// mirror support, proxy request to primary upstream and return it's response, replay request asynchronously.
+	UpstreamUrl string `yaml:"upstream_url"` // enable mirror mode if not empty, such as: http://127.0.0.1:8080
 
 	// mesh support
 	HTTP2    bool `yaml:"http2"`    // enable http2
@@ -39,15 +103,49 @@ type HttpServerConfig struct {
 
 type HttpOutputConfig struct {
 	Workers           int                           `yaml:"workers"`
-	RedirectUrl       string                        `yaml:"redirect_url"`
+	RedirectUrl       string                        `yaml:"redirect_url"` // single target, it's added before targets
 	HttpRequestConfig *httpclient.HttpRequestConfig `yaml:"http_request_config"`
+
+	// spread requests across targets, ejected targets by passive health check are skipped.
+	Targets  []*balancer.Target `yaml:"targets"`
+	Balancer *balancer.Config   `yaml:"balancer"`
+
+	// values issued by replay target, such as csrf token, substitute production values in subsequent requests of same session.
+	// values are learned from production response, so it works with http input in mirror mode (upstream_url) only.
+	Correlations []*correlation.Rule `yaml:"correlations"`
+}
+
+// Send each request to all targets concurrently, responses are compared between targets.
+type BroadcastOutputConfig struct {
+	Workers           int                           `yaml:"workers"`
+	Targets           []*BroadcastTarget            `yaml:"targets"` // first target is baseline of comparison
+	HttpRequestConfig *httpclient.HttpRequestConfig `yaml:"http_request_config"`
+
+	// volatile headers, json fields and body parts ignored by comparison, such as timestamp and trace id.
+	Comparison *comparison.Config `yaml:"comparison"`
+}
+
+type BroadcastTarget struct {
+	Name string `yaml:"name"` // default host of url
+	Url  string `yaml:"url"`  // base url, path and query of original request are appended to it
 }
 
 type RawInputConfig struct {
-	RawSocketAddr string `yaml:"raw_socket_addr"`
+	RawSocketAddr string `yaml:"raw_socket_addr"` // capture by AF_PACKET socket, format '{device}:{port}', such as: 'eth0:80', ':80'
 	DeviceName    string `yaml:"device_name"`
-	PcapFilename  string `yaml:"pcap_filename"`
-	BpfFilter     string `yaml:"bpf_filter"`
+	PcapFilename  string `yaml:"pcap_filename"` // pcap or pcapng, may be gzip or zstd compressed, or directory or glob of rotated files
+	BpfFilter     string `yaml:"bpf_filter"`    // raw socket capture compiles it by libpcap too
+
+	RawSocketBufferMb int `yaml:"raw_socket_buffer_mb"` // AF_PACKET ring buffer size, in MB, default 32MB
+
+	// emit message levels: packet, tcp, http. default decided by routed output plugins.
+	MsgLevels []string `yaml:"msg_levels"`
+
+	// tcp reassembly memory limit, a page is about 1900 bytes.
+	MaxBufferedPagesPerConn int `yaml:"max_buffered_pages_per_conn"` // default 1024
+	MaxBufferedPagesTotal   int `yaml:"max_buffered_pages_total"`    // default 65536
+	OutOfOrderTimeoutMs     int `yaml:"out_of_order_timeout"`        // stop waiting lost segment, in millisecond, default 10s
+	ConnectionTimeoutMs     int `yaml:"connection_timeout"`          // close connection without activity, in millisecond, default 2 minutes
 }
 
 type RawOutputConfig struct {
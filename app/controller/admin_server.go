@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"xtransform/app/common/httphandle"
+	"xtransform/app/config"
+	"xtransform/app/scheduler"
+)
+
+const defaultAdminAddr = "127.0.0.1"
+
+// Admin http server, manage scheduler and expose stats. it's bound to separate port with token authentication.
+type AdminServer struct {
+	config     *config.AdminConfig
+	scheduler  *scheduler.Scheduler
+	httpServer *http.Server
+}
+
+func NewAdminServer(config *config.AdminConfig, scheduler *scheduler.Scheduler) (*AdminServer, error) {
+	if nil == config || config.Port <= 0 || nil == scheduler {
+		return nil, errors.New("invalid params")
+	}
+	if len(strings.TrimSpace(config.Token)) == 0 {
+		return nil, errors.New("admin token is required")
+	}
+	if len(strings.TrimSpace(config.Addr)) == 0 {
+		config.Addr = defaultAdminAddr
+	}
+
+	server := &AdminServer{config: config, scheduler: scheduler}
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+
+	api := engine.Group("/api", server.authenticate)
+	scheduleController := &ScheduleController{scheduler: scheduler}
+	api.GET("/plugins", scheduleController.ListPlugins)
+	api.POST("/plugins", scheduleController.CreatePlugin)
+	api.DELETE("/plugins/:name", scheduleController.DeletePlugin)
+	api.POST("/plugins/:name/pause", scheduleController.PausePlugin)
+	api.POST("/plugins/:name/resume", scheduleController.ResumePlugin)
+	api.GET("/endpoints", scheduleController.ListEndpoints)
+	api.POST("/endpoints", scheduleController.CreateEndpoint)
+	api.DELETE("/endpoints/:id", scheduleController.DeleteEndpoint)
+	api.POST("/endpoints/:id/pause", scheduleController.PauseEndpoint)
+	api.POST("/endpoints/:id/resume", scheduleController.ResumeEndpoint)
+	api.GET("/replay", scheduleController.ReplayStatus)
+	api.POST("/replay/start", scheduleController.StartReplay)
+	api.POST("/replay/stop", scheduleController.StopReplay)
+
+	statController := &StatController{}
+	api.GET("/stats", statController.Stats)
+	api.GET("/errors", statController.RecentErrors)
+	api.GET("/diffs", statController.RecentDiffs)
+	api.GET("/divergences", statController.RecentDivergences)
+
+	// dashboard page is public, it's call api with token input by user.
+	engine.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/dashboard")
+	})
+	engine.GET("/dashboard", Dashboard)
+
+	server.httpServer = &http.Server{
+		Addr:    net.JoinHostPort(config.Addr, strconv.Itoa(config.Port)),
+		Handler: engine,
+	}
+	return server, nil
+}
+
+func (server *AdminServer) Start() error {
+	listener, err := net.Listen("tcp", server.httpServer.Addr)
+	if nil != err {
+		return err
+	}
+	log.Printf("[Admin-server] listen on %s", server.httpServer.Addr)
+	go func() {
+		if err := server.httpServer.Serve(listener); nil != err && err != http.ErrServerClosed {
+			log.Printf("[Admin-server] serve fail, cause: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Request must carry token by 'Authorization: Bearer {token}' or 'X-Admin-Token: {token}'.
+func (server *AdminServer) authenticate(c *gin.Context) {
+	token := c.GetHeader("X-Admin-Token")
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(server.config.Token)) != 1 {
+		httphandle.WriteJsonStatus(c.Writer, http.StatusUnauthorized, httphandle.UNAUTHORIZED)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func (server *AdminServer) Close() {
+	server.httpServer.Close()
+	log.Println("Close admin-server finished.")
+}
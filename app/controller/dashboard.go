@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// Dashboard page, it's single html file without external resources, so it works in offline network.
+func Dashboard(c *gin.Context) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	c.String(http.StatusOK, dashboardHtml)
+}
+
+const dashboardHtml = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Traffic Replay Dashboard</title>
+<style>
+  body { font-family: -apple-system, Helvetica, Arial, sans-serif; margin: 0; background: #f4f5f7; color: #222; }
+  header { background: #24292e; color: #fff; padding: 10px 20px; display: flex; align-items: center; }
+  header h1 { font-size: 18px; margin: 0; flex: 1; }
+  header input { width: 220px; }
+  main { padding: 16px 20px; display: grid; grid-template-columns: 1fr 1fr; grid-gap: 16px; }
+  section { background: #fff; border-radius: 4px; padding: 12px 16px; box-shadow: 0 1px 2px rgba(0,0,0,.1); }
+  section.wide { grid-column: 1 / 3; }
+  h2 { font-size: 15px; margin: 0 0 10px 0; }
+  table { width: 100%; border-collapse: collapse; font-size: 13px; }
+  th, td { text-align: left; padding: 4px 6px; border-bottom: 1px solid #eee; vertical-align: top; }
+  .metrics { display: flex; }
+  .metric { flex: 1; text-align: center; }
+  .metric b { display: block; font-size: 22px; }
+  .paused { color: #b08800; }
+  .running { color: #22863a; }
+  .error { color: #cb2431; }
+  pre { white-space: pre-wrap; word-break: break-all; max-height: 160px; overflow: auto; margin: 0; font-size: 12px; background: #fafbfc; }
+  button { font-size: 12px; }
+</style>
+</head>
+<body>
+<header>
+  <h1>Traffic Replay</h1>
+  <span id="replay"></span>&nbsp;
+  <button id="replayBtn">-</button>&nbsp;&nbsp;
+  <input id="token" type="password" placeholder="admin token">
+</header>
+<main>
+  <section class="wide">
+    <div class="metrics">
+      <div class="metric"><b id="total">-</b>requests</div>
+      <div class="metric"><b id="failed">-</b>failed</div>
+      <div class="metric"><b id="retries">-</b>retries</div>
+      <div class="metric"><b id="p50">-</b>p50 ms</div>
+      <div class="metric"><b id="p90">-</b>p90 ms</div>
+      <div class="metric"><b id="p99">-</b>p99 ms</div>
+      <div class="metric"><b id="max">-</b>max ms</div>
+      <div class="metric"><b id="diffed">-</b>diffs / compared</div>
+      <div class="metric"><b id="diverged">-</b>divergences / broadcasts</div>
+    </div>
+  </section>
+  <section>
+    <h2>Throughput (req/s, last 60s)</h2>
+    <canvas id="throughput" width="560" height="160"></canvas>
+  </section>
+  <section>
+    <h2>Errors (err/s, last 60s)</h2>
+    <canvas id="errors" width="560" height="160"></canvas>
+  </section>
+  <section>
+    <h2>Plugins</h2>
+    <table><thead><tr><th>Name</th><th>Kind</th><th>Queue</th><th>State</th><th></th></tr></thead><tbody id="plugins"></tbody></table>
+  </section>
+  <section>
+    <h2>Endpoints</h2>
+    <table><thead><tr><th>Input</th><th>Output</th><th>State</th><th></th></tr></thead><tbody id="endpoints"></tbody></table>
+  </section>
+  <section class="wide">
+    <h2>Recent diffs between production and replay</h2>
+    <table><thead><tr><th>Time</th><th>Url</th><th>Status</th><th>Production</th><th>Replay</th></tr></thead><tbody id="diffs"></tbody></table>
+  </section>
+  <section class="wide">
+    <h2>Recent divergences between broadcast targets</h2>
+    <table><thead><tr><th>Time</th><th>Output</th><th>Uri</th><th>Responses</th></tr></thead><tbody id="divergences"></tbody></table>
+  </section>
+  <section class="wide">
+    <h2>Recent errors</h2>
+    <table><thead><tr><th>Time</th><th>Output</th><th>Url</th><th>Status</th><th>Error</th></tr></thead><tbody id="recentErrors"></tbody></table>
+  </section>
+</main>
+<script>
+(function () {
+  var tokenInput = document.getElementById("token");
+  tokenInput.value = localStorage.getItem("adminToken") || "";
+  tokenInput.onchange = function () {
+    localStorage.setItem("adminToken", tokenInput.value);
+    refresh();
+  };
+
+  function api(method, path, callback) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, "/api" + path);
+    xhr.setRequestHeader("Authorization", "Bearer " + tokenInput.value);
+    xhr.onload = function () {
+      var res = JSON.parse(xhr.responseText);
+      if (xhr.status !== 200) {
+        if (xhr.status !== 401) {
+          alert(res.msg);
+        }
+        return;
+      }
+      if (callback) {
+        callback(res.data);
+      }
+    };
+    xhr.send();
+  }
+
+  // escape quotes too, so it's safe in both element text and quoted attribute.
+  var escapes = {"&": "&amp;", "<": "&lt;", ">": "&gt;", "\"": "&quot;", "'": "&#39;"};
+  function text(s) {
+    return (s === undefined || s === null ? "" : String(s)).replace(/[&<>"']/g, function (c) {
+      return escapes[c];
+    });
+  }
+
+  function time(nano) {
+    return nano ? new Date(nano / 1e6).toLocaleTimeString() : "";
+  }
+
+  function button(label, method, path) {
+    return "<button data-method='" + text(method) + "' data-path='" + text(path) + "'>" + text(label) + "</button>";
+  }
+
+  document.body.onclick = function (e) {
+    var path = e.target.getAttribute("data-path");
+    if (path) {
+      api(e.target.getAttribute("data-method"), path, refresh);
+    }
+  };
+
+  function drawChart(id, points, field, color) {
+    var canvas = document.getElementById(id), ctx = canvas.getContext("2d");
+    var w = canvas.width, h = canvas.height, max = 1;
+    points.forEach(function (p) { max = Math.max(max, p[field]); });
+    ctx.clearRect(0, 0, w, h);
+    ctx.fillStyle = "#888";
+    ctx.font = "11px sans-serif";
+    ctx.fillText(String(max), 2, 10);
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    points.forEach(function (p, i) {
+      var x = i * w / Math.max(points.length - 1, 1), y = h - 2 - p[field] * (h - 14) / max;
+      if (i === 0) { ctx.moveTo(x, y); } else { ctx.lineTo(x, y); }
+    });
+    ctx.stroke();
+  }
+
+  function refresh() {
+    api("GET", "/stats", function (stats) {
+      document.getElementById("total").innerHTML = stats.total;
+      document.getElementById("failed").innerHTML = stats.failed;
+      document.getElementById("retries").innerHTML = stats.retries;
+      document.getElementById("p50").innerHTML = stats.latency_p50_ms.toFixed(1);
+      document.getElementById("p90").innerHTML = stats.latency_p90_ms.toFixed(1);
+      document.getElementById("p99").innerHTML = stats.latency_p99_ms.toFixed(1);
+      document.getElementById("max").innerHTML = stats.latency_max_ms.toFixed(1);
+      document.getElementById("diffed").innerHTML = stats.diffed + " / " + stats.compared;
+      document.getElementById("diverged").innerHTML = stats.diverged + " / " + stats.broadcasts;
+      drawChart("throughput", stats.throughput, "requests", "#0366d6");
+      drawChart("errors", stats.throughput, "errors", "#cb2431");
+    });
+    api("GET", "/replay", function (data) {
+      document.getElementById("replay").innerHTML = data.replaying ? "<span class='running'>replaying</span>" : "<span class='paused'>stopped</span>";
+      var btn = document.getElementById("replayBtn");
+      btn.innerHTML = data.replaying ? "Stop" : "Start";
+      btn.setAttribute("data-method", "POST");
+      btn.setAttribute("data-path", data.replaying ? "/replay/stop" : "/replay/start");
+    });
+    api("GET", "/plugins", function (plugins) {
+      document.getElementById("plugins").innerHTML = (plugins || []).map(function (p) {
+        var path = "/plugins/" + encodeURIComponent(p.name);
+        return "<tr><td>" + text(p.name) + "</td><td>" + text(p.kind) + "</td><td>" + p.queue_len + " / " + p.queue_cap + "</td>" +
+          "<td class='" + (p.paused ? "paused'>paused" : "running'>running") + "</td>" +
+          "<td>" + (p.paused ? button("Resume", "POST", path + "/resume") : button("Pause", "POST", path + "/pause")) + "</td></tr>";
+      }).join("");
+    });
+    api("GET", "/endpoints", function (endpoints) {
+      document.getElementById("endpoints").innerHTML = (endpoints || []).map(function (e) {
+        var path = "/endpoints/" + encodeURIComponent(e.id);
+        return "<tr><td>" + text(e.input) + "</td><td>" + text(e.output) + "</td>" +
+          "<td class='" + (e.paused ? "paused'>paused" : "running'>running") + "</td>" +
+          "<td>" + (e.paused ? button("Resume", "POST", path + "/resume") : button("Pause", "POST", path + "/pause")) + "</td></tr>";
+      }).join("");
+    });
+    api("GET", "/diffs?limit=10", function (diffs) {
+      document.getElementById("diffs").innerHTML = (diffs || []).map(function (d) {
+        var status = d.prod_status === d.replay_status ? d.prod_status : "<span class='error'>" + d.prod_status + " / " + d.replay_status + "</span>";
+        return "<tr><td>" + time(d.time_nano) + "</td><td>" + text(d.req_url) + "</td><td>" + status + "</td>" +
+          "<td><pre>" + text(d.prod_body) + "</pre></td><td><pre>" + text(d.replay_body) + "</pre></td></tr>";
+      }).join("");
+    });
+    api("GET", "/divergences?limit=10", function (divergences) {
+      document.getElementById("divergences").innerHTML = (divergences || []).map(function (d) {
+        var responses = (d.responses || []).map(function (r) {
+          return "<b>" + text(r.target) + "</b> " + (r.err ? "<span class='error'>" + text(r.err) + "</span>" : r.status) + "<pre>" + text(r.body) + "</pre>";
+        }).join("");
+        return "<tr><td>" + time(d.time_nano) + "</td><td>" + text(d.output_plugin) + "</td><td>" + text(d.req_uri) + "</td><td>" + responses + "</td></tr>";
+      }).join("");
+    });
+    api("GET", "/errors?limit=10", function (errors) {
+      document.getElementById("recentErrors").innerHTML = (errors || []).map(function (e) {
+        return "<tr><td>" + time(e.time_nano) + "</td><td>" + text(e.output_plugin) + "</td><td>" + text(e.req_url) + "</td>" +
+          "<td>" + (e.status_code || "") + "</td><td class='error'>" + text(e.err) + "</td></tr>";
+      }).join("");
+    });
+  }
+
+  refresh();
+  setInterval(refresh, 2000);
+})();
+</script>
+</body>
+</html>
+`
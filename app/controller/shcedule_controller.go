@@ -1,7 +1,151 @@
 package controller
 
-import "github.com/gin-gonic/gin"
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"xtransform/app/common/httphandle"
+	"xtransform/app/config"
+	"xtransform/app/plugins"
+	"xtransform/app/scheduler"
+)
 
-func ScheduleController(c *gin.Context) {
-	c.GetPostForm("http_input_config")
+// Manage plugins, endpoints and replay of scheduler.
+type ScheduleController struct {
+	scheduler *scheduler.Scheduler
+}
+
+type pluginState struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	MsgLevel int    `json:"msg_level"`
+	Paused   bool   `json:"paused"`
+	QueueLen int    `json:"queue_len"`
+	QueueCap int    `json:"queue_cap"`
+}
+
+type endpointState struct {
+	Id     string `json:"id"`
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Paused bool   `json:"paused"`
+}
+
+// Create plugin request, options is same as plugin config file.
+type createPluginRequest struct {
+	Kind    string                 `json:"kind"` // input, output
+	Name    string                 `json:"name"`
+	Type    string                 `json:"type"`
+	Options map[string]interface{} `json:"options"`
+}
+
+type createEndpointRequest struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+func (controller *ScheduleController) ListPlugins(c *gin.Context) {
+	var states []*pluginState
+	for _, kind := range []string{plugins.PluginKindInput, plugins.PluginKindOutput} {
+		for _, plugin := range controller.scheduler.Plugins(kind) {
+			queue := plugin.GetMessage()
+			states = append(states, &pluginState{
+				Name:     plugin.GetPluginName(),
+				Kind:     kind,
+				MsgLevel: plugin.GetMsgLevel(),
+				Paused:   controller.scheduler.IsPluginPaused(plugin.GetPluginName()),
+				QueueLen: len(queue),
+				QueueCap: cap(queue),
+			})
+		}
+	}
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, states)
+}
+
+func (controller *ScheduleController) CreatePlugin(c *gin.Context) {
+	request := &createPluginRequest{}
+	if err := c.ShouldBindJSON(request); nil != err {
+		httphandle.WriteJsonStatusRawData(c.Writer, http.StatusBadRequest, httphandle.BAD_REQUEST, err.Error(), nil)
+		return
+	}
+	pluginConfig := &config.PluginConfig{Name: request.Name, Type: request.Type, Options: request.Options}
+	if err := controller.scheduler.AddPluginByConfig(request.Kind, pluginConfig); nil != err {
+		httphandle.WriteJsonStatusRawData(c.Writer, http.StatusBadRequest, httphandle.BAD_REQUEST, err.Error(), nil)
+		return
+	}
+	httphandle.WriteJson(c.Writer, httphandle.OK)
+}
+
+func (controller *ScheduleController) DeletePlugin(c *gin.Context) {
+	writeResult(c, controller.scheduler.RemovePlugin(c.Param("name")))
+}
+
+func (controller *ScheduleController) PausePlugin(c *gin.Context) {
+	writeResult(c, controller.scheduler.PausePlugin(c.Param("name")))
+}
+
+func (controller *ScheduleController) ResumePlugin(c *gin.Context) {
+	writeResult(c, controller.scheduler.ResumePlugin(c.Param("name")))
+}
+
+func (controller *ScheduleController) ListEndpoints(c *gin.Context) {
+	var states []*endpointState
+	for _, endpoint := range controller.scheduler.Endpoints() {
+		states = append(states, &endpointState{
+			Id:     endpoint.Id,
+			Input:  endpoint.Input.GetPluginName(),
+			Output: endpoint.Output.GetPluginName(),
+			Paused: endpoint.Paused,
+		})
+	}
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, states)
+}
+
+func (controller *ScheduleController) CreateEndpoint(c *gin.Context) {
+	request := &createEndpointRequest{}
+	if err := c.ShouldBindJSON(request); nil != err {
+		httphandle.WriteJsonStatusRawData(c.Writer, http.StatusBadRequest, httphandle.BAD_REQUEST, err.Error(), nil)
+		return
+	}
+	endpoint, err := controller.scheduler.AddEndpoint(request.Input, request.Output)
+	if nil != err {
+		httphandle.WriteJsonStatusRawData(c.Writer, http.StatusBadRequest, httphandle.BAD_REQUEST, err.Error(), nil)
+		return
+	}
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, &endpointState{Id: endpoint.Id, Input: request.Input, Output: request.Output})
+}
+
+// Endpoint id contains '->', it's should be url encoded, such as: 'input-raw-plugin-%3Eoutput-http-plugin'.
+func (controller *ScheduleController) DeleteEndpoint(c *gin.Context) {
+	writeResult(c, controller.scheduler.RemoveEndpoint(c.Param("id")))
+}
+
+func (controller *ScheduleController) PauseEndpoint(c *gin.Context) {
+	writeResult(c, controller.scheduler.PauseEndpoint(c.Param("id")))
+}
+
+func (controller *ScheduleController) ResumeEndpoint(c *gin.Context) {
+	writeResult(c, controller.scheduler.ResumeEndpoint(c.Param("id")))
+}
+
+func (controller *ScheduleController) ReplayStatus(c *gin.Context) {
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, gin.H{"replaying": controller.scheduler.IsReplaying()})
+}
+
+func (controller *ScheduleController) StartReplay(c *gin.Context) {
+	controller.scheduler.StartReplay()
+	httphandle.WriteJson(c.Writer, httphandle.OK)
+}
+
+func (controller *ScheduleController) StopReplay(c *gin.Context) {
+	controller.scheduler.StopReplay()
+	httphandle.WriteJson(c.Writer, httphandle.OK)
+}
+
+// Scheduler only return error if plugin or endpoint not found.
+func writeResult(c *gin.Context, err error) {
+	if nil != err {
+		httphandle.WriteJsonStatusRawData(c.Writer, http.StatusNotFound, httphandle.NOT_FOUND, err.Error(), nil)
+		return
+	}
+	httphandle.WriteJson(c.Writer, httphandle.OK)
 }
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"xtransform/app/common/httphandle"
+	"xtransform/app/service"
+)
+
+const defaultRecentErrors = 20 // default limit of recent errors and diffs
+
+// Expose replay stats and recent errors.
+type StatController struct {
+}
+
+func (controller *StatController) Stats(c *gin.Context) {
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, service.HttpStatService.Snapshot())
+}
+
+func (controller *StatController) RecentErrors(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRecentErrors)))
+	if nil != err {
+		httphandle.WriteJson(c.Writer, httphandle.BAD_REQUEST)
+		return
+	}
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, service.HttpStatService.RecentErrors(limit))
+}
+
+// Recent diffs between production response and replay response, only exist in mirror mode.
+func (controller *StatController) RecentDiffs(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRecentErrors)))
+	if nil != err {
+		httphandle.WriteJson(c.Writer, httphandle.BAD_REQUEST)
+		return
+	}
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, service.HttpStatService.RecentDiffs(limit))
+}
+
+// Recent divergences between targets of broadcast output.
+func (controller *StatController) RecentDivergences(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultRecentErrors)))
+	if nil != err {
+		httphandle.WriteJson(c.Writer, httphandle.BAD_REQUEST)
+		return
+	}
+	httphandle.WriteJsonData(c.Writer, httphandle.OK, service.HttpStatService.RecentDivergences(limit))
+}
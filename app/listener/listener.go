@@ -3,155 +3,135 @@ package listener
 import (
 	"errors"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"net"
-	"os"
-	"path/filepath"
+	"strings"
 	"sync"
 )
 
 const (
-	ReadModeOnLive = 0
-	ReadModeOnFile = 1
+	ReadModeOnLive      = 0
+	ReadModeOnFile      = 1
+	ReadModeOnRawSocket = 2
 )
 
 const AllDevice = "all"
 
-type Listener struct {
-	mutex sync.RWMutex
+// default AF_PACKET ring buffer size, in MB.
+const defaultRawSocketBufferMb = 32
 
+type Listener struct {
 	readMode     int
 	deviceName   string
 	pcapFilename string
 	bpfFilter    string
 
+	// raw socket capture, only tcp traffic with this destination port is captured if port > 0, and bpfFilter is matched if set.
+	port     int
+	bufferMb int
+
 	receiveChan chan gopacket.Packet
-	exit        bool
+	exitChan    chan struct{} // closed when listener closed, readers close their handles and stop sending packets
+	closeOnce   sync.Once
+
+	mutex sync.Mutex
+	err   error // first error of reading capture files
 }
 
 func NewListener(readMode int, deviceName, filename string, bpfFilter string) (*Listener, error) {
-	// validate file is exist
+	// validate capture files are exist, filename may be a directory or glob of rotated files.
 	if readMode == ReadModeOnFile {
-		if "" == filename || len(filename) == 0 {
+		if len(strings.TrimSpace(filename)) == 0 {
 			return nil, errors.New("filename is empty")
 		}
-		filePathAbs, err := filepath.Abs(filename)
-		if nil != err {
+		if _, err := captureFilenames(filename); nil != err {
 			return nil, err
 		}
-		fileInfo, err := os.Stat(filePathAbs)
-		if nil != err {
-			// file is not exist.
-			return nil, err
-		}
-		if fileInfo.IsDir() {
-			return nil, errors.New("file type error, file is dir")
-		}
 	}
 
 	return &Listener{
-		mutex:        sync.RWMutex{},
 		readMode:     readMode,
 		deviceName:   deviceName,
 		pcapFilename: filename,
 		bpfFilter:    bpfFilter,
+		bufferMb:     defaultRawSocketBufferMb,
 		receiveChan:  make(chan gopacket.Packet),
-		exit:         false,
+		exitChan:     make(chan struct{}),
 	}, nil
 }
 
+// Capture traffic by AF_PACKET socket, it's not depend on libpcap.
+// deviceName is empty or 'all' means capture all NICs, port <= 0 means capture all tcp traffic.
+// bpfFilter is compiled by libpcap, it's not supported in 'nopcap' build.
+func NewRawSocketListener(deviceName string, port int, bpfFilter string, bufferMb int) (*Listener, error) {
+	if port > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	if bufferMb <= 0 {
+		bufferMb = defaultRawSocketBufferMb
+	}
+
+	return &Listener{
+		readMode:    ReadModeOnRawSocket,
+		deviceName:  deviceName,
+		bpfFilter:   bpfFilter,
+		port:        port,
+		bufferMb:    bufferMb,
+		receiveChan: make(chan gopacket.Packet),
+		exitChan:    make(chan struct{}),
+	}, nil
+}
+
+// Packet channel of capture files is closed after all packets are read, live capture never close it.
 func (l *Listener) Listen() (<-chan gopacket.Packet, error) {
 	var err error
-	if l.readMode == ReadModeOnLive {
+	switch l.readMode {
+	case ReadModeOnLive:
 		err = l.openLivePcap()
-	} else {
+	case ReadModeOnRawSocket:
+		err = l.openRawSocket()
+	default:
 		err = l.readPcapFile()
 	}
 
 	return l.receiveChan, err
 }
 
-func (l *Listener) openLivePcap() error {
-	devices, err := pcap.FindAllDevs()
-	if nil != err {
-		panic(err)
-	}
-
-	for _, device := range devices {
-		if device.Name != l.deviceName && l.deviceName != AllDevice {
-			continue
-		}
-
-		go func(ifs pcap.Interface) {
-			snapLen := int32(65535)
-			if it, err := net.InterfaceByName(ifs.Name); err == nil {
-				// auto-guess max length of packet to capture
-				snapLen = int32(it.MTU + 68*2)
-			}
-
-			handle, err := pcap.OpenLive(ifs.Name, snapLen, true, pcap.BlockForever)
-			if nil != err {
-				panic(err)
-			}
-			defer handle.Close()
-
-			if len(l.bpfFilter) > 0 {
-				handle.SetBPFFilter(l.bpfFilter)
-			}
-			// Special case for tunnel interface
-			// See: https://github.com/google/gopacket/issues/99
-			var decoder gopacket.Decoder
-			if 12 == handle.LinkType() {
-				decoder = layers.LayerTypeIPv4
-			} else {
-				decoder = handle.LinkType()
-			}
-
-			packetSource := gopacket.NewPacketSource(handle, decoder)
-			for packet := range packetSource.Packets() {
-				if l.exit {
-					return
-				}
-				l.receiveChan <- packet
-			}
-		}(device)
-	}
-	return nil
+// Stop capture, handles are closed by their readers, packet channel is not read any more.
+func (l *Listener) Close() {
+	l.closeOnce.Do(func() {
+		close(l.exitChan)
+	})
 }
 
-func (l *Listener) readPcapFile() error {
-	handle, err := pcap.OpenOffline(l.pcapFilename)
-	if nil != err {
-		return err
-	}
-	defer handle.Close()
-
-	if len(l.bpfFilter) > 0 {
-		handle.SetBPFFilter(l.bpfFilter)
-	}
+// Error of reading capture files, it's set before packet channel closed.
+func (l *Listener) Err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.err
+}
 
-	// Special case for tunnel interface
-	// See: https://github.com/google/gopacket/issues/99
-	var decoder gopacket.Decoder
-	if 12 == handle.LinkType() {
-		decoder = layers.LayerTypeIPv4
-	} else {
-		decoder = handle.LinkType()
+func (l *Listener) setErr(err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if nil == l.err {
+		l.err = err
 	}
+}
 
-	packetSource := gopacket.NewPacketSource(handle, decoder)
-	for packet := range packetSource.Packets() {
-		if l.exit {
-			break
-		}
-		l.receiveChan <- packet
+func (l *Listener) isClosed() bool {
+	select {
+	case <-l.exitChan:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-func (l *Listener) Close() {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	l.exit = true
+// Send packet to channel, return false if listener closed, so reader never blocked after it's closed.
+func (l *Listener) emit(packet gopacket.Packet) bool {
+	select {
+	case l.receiveChan <- packet:
+		return true
+	case <-l.exitChan:
+		return false
+	}
 }
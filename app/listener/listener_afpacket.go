@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package listener
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AF_PACKET TPACKET_V3 ring buffer layout.
+const (
+	rawSocketFrameSize   = 1 << 16 // must hold a whole packet, include gro/gso packet.
+	rawSocketBlockSize   = rawSocketFrameSize * 128
+	rawSocketPollTimeout = 100 * time.Millisecond // help check listener exit.
+)
+
+// Interface types whose frames start with ethernet header, see ARPHRD_* in linux/if_arp.h.
+const (
+	arphrdEther    = 1
+	arphrdLoopback = 772
+)
+
+func (l *Listener) openRawSocket() error {
+	filter, err := l.rawSocketFilter(compileRawSocketFilter)
+	if nil != err {
+		return err
+	}
+
+	opts := []interface{}{
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptFrameSize(rawSocketFrameSize),
+		afpacket.OptBlockSize(rawSocketBlockSize),
+		afpacket.OptNumBlocks(rawSocketNumBlocks(l.bufferMb)),
+		afpacket.OptPollTimeout(rawSocketPollTimeout),
+	}
+	// capture all NICs traffic if not bind interface, filter and decoder assume ethernet frame.
+	bindDevice := len(l.deviceName) > 0 && l.deviceName != AllDevice
+	if bindDevice {
+		if _, err := net.InterfaceByName(l.deviceName); nil != err {
+			return err
+		}
+		if ethernet, err := isEthernetInterface(l.deviceName); nil != err {
+			return err
+		} else if !ethernet {
+			return fmt.Errorf("raw socket capture only supports ethernet interface, '%s' is not", l.deviceName)
+		}
+		opts = append(opts, afpacket.OptInterface(l.deviceName))
+	}
+
+	handle, err := afpacket.NewTPacket(opts...)
+	if nil != err {
+		if os.IsPermission(err) {
+			log.Println("Open raw socket need CAP_NET_RAW capability.")
+		}
+		return err
+	}
+
+	if len(filter) > 0 {
+		if err := handle.SetBPF(filter); nil != err {
+			handle.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer handle.Close()
+		ethernetIndexes := make(map[int]bool)
+		for {
+			if l.isClosed() {
+				return
+			}
+
+			data, ci, err := handle.ReadPacketData()
+			if err == afpacket.ErrTimeout {
+				continue
+			} else if nil != err {
+				log.Printf("[listener] read raw socket fail, cause: %v", err)
+				return
+			}
+			// tun, ppp... packets have no ethernet header, they're dropped when capture all NICs.
+			if !bindDevice && !isEthernetIndex(ethernetIndexes, ci.InterfaceIndex) {
+				continue
+			}
+
+			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			packet.Metadata().CaptureInfo = ci
+			if !l.emit(packet) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Kernel filter of raw socket, user bpf filter is compiled by libpcap, port filter is built without it.
+func (l *Listener) rawSocketFilter(compileFilter func(linkType layers.LinkType, expr string) ([]bpf.RawInstruction, error)) ([]bpf.RawInstruction, error) {
+	if len(strings.TrimSpace(l.bpfFilter)) > 0 {
+		expr := l.bpfFilter
+		if l.port > 0 {
+			expr = fmt.Sprintf("tcp dst port %d and (%s)", l.port, l.bpfFilter)
+		}
+		filter, err := compileFilter(layers.LinkTypeEthernet, expr)
+		if nil != err {
+			return nil, fmt.Errorf("compile bpf filter '%s' fail, cause: %v", expr, err)
+		}
+		return filter, nil
+	}
+	if l.port > 0 {
+		return tcpDstPortFilter(l.port)
+	}
+	return nil, nil
+}
+
+// Interface type is read from sysfs, loopback frame has ethernet header too.
+func isEthernetInterface(name string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "type"))
+	if nil != err {
+		return false, err
+	}
+	arphrd, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if nil != err {
+		return false, err
+	}
+	return arphrd == arphrdEther || arphrd == arphrdLoopback, nil
+}
+
+// Check interface of packet, result is cached by interface index, interfaces added after capture started are checked too.
+func isEthernetIndex(cache map[int]bool, index int) bool {
+	ethernet, ok := cache[index]
+	if !ok {
+		if iface, err := net.InterfaceByIndex(index); nil == err {
+			ethernet, _ = isEthernetInterface(iface.Name)
+		}
+		cache[index] = ethernet
+	}
+	return ethernet
+}
+
+// Ring buffer blocks count, the whole ring buffer size is bufferMb.
+func rawSocketNumBlocks(bufferMb int) int {
+	num := bufferMb * 1024 * 1024 / rawSocketBlockSize
+	if num < 1 {
+		num = 1
+	}
+	return num
+}
+
+// Build kernel filter same as 'tcp dst port {port}', compile it without libpcap.
+// Output of 'tcpdump -dd tcp dst port 80' is the reference.
+func tcpDstPortFilter(port int) ([]bpf.RawInstruction, error) {
+	return bpf.Assemble([]bpf.Instruction{
+		// ethernet type
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x86dd, SkipFalse: 4},
+
+		// ipv6: next header is tcp, tcp destination port
+		bpf.LoadAbsolute{Off: 20, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x06, SkipFalse: 11},
+		bpf.LoadAbsolute{Off: 56, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(port), SkipTrue: 8, SkipFalse: 9},
+
+		// ipv4: protocol is tcp, not a fragment, tcp destination port
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x0800, SkipFalse: 8},
+		bpf.LoadAbsolute{Off: 23, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0x06, SkipFalse: 6},
+		bpf.LoadAbsolute{Off: 20, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+		bpf.LoadMemShift{Off: 14},
+		bpf.LoadIndirect{Off: 16, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(port), SkipFalse: 1},
+
+		bpf.RetConstant{Val: 0x40000},
+		bpf.RetConstant{Val: 0},
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package listener
+
+import "errors"
+
+func (l *Listener) openRawSocket() error {
+	return errors.New("raw socket capture only supported on linux")
+}
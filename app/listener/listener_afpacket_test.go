@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package listener
+
+import (
+	"errors"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"testing"
+)
+
+func TestRawSocketFilter(t *testing.T) {
+	accept, _ := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0x40000}})
+	cases := []struct {
+		name         string
+		port         int
+		filter       string
+		expectExpr   string // expression compiled by libpcap
+		expectFilter bool
+	}{
+		{"no filter", 0, "", "", false},
+		{"port filter", 80, "", "", true},
+		{"bpf filter", 0, "src host 10.0.0.1", "src host 10.0.0.1", true},
+		{"port and bpf filter", 80, "src host 10.0.0.1 or src host 10.0.0.2", "tcp dst port 80 and (src host 10.0.0.1 or src host 10.0.0.2)", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l, err := NewRawSocketListener("", c.port, c.filter, 0)
+			if nil != err {
+				t.Fatal(err)
+			}
+			var compiledExpr string
+			filter, err := l.rawSocketFilter(func(linkType layers.LinkType, expr string) ([]bpf.RawInstruction, error) {
+				if linkType != layers.LinkTypeEthernet {
+					t.Fatalf("link type expect ethernet, actual %v", linkType)
+				}
+				compiledExpr = expr
+				return accept, nil
+			})
+			if nil != err {
+				t.Fatalf("build filter fail, cause: %v", err)
+			}
+			if compiledExpr != c.expectExpr || (len(filter) > 0) != c.expectFilter {
+				t.Fatalf("expect expr '%s' and filter %v, actual '%s' and %d instructions", c.expectExpr, c.expectFilter, compiledExpr, len(filter))
+			}
+		})
+	}
+
+	l, _ := NewRawSocketListener("", 80, "invalid filter", 0)
+	if _, err := l.rawSocketFilter(func(layers.LinkType, string) ([]bpf.RawInstruction, error) {
+		return nil, errors.New("syntax error")
+	}); nil == err {
+		t.Fatalf("expect invalid bpf filter fail")
+	}
+}
+
+func TestIsEthernetInterface(t *testing.T) {
+	if ethernet, err := isEthernetInterface("lo"); nil != err || !ethernet {
+		t.Fatalf("loopback expect ethernet, actual %v, error: %v", ethernet, err)
+	}
+	if _, err := isEthernetInterface("not-exist"); nil == err {
+		t.Fatalf("expect not exist interface fail")
+	}
+}
@@ -0,0 +1,265 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Magic number of capture file and compressed file.
+var (
+	magicGzip   = []byte{0x1f, 0x8b}
+	magicZstd   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicPcapng = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+)
+
+// Filter packets of capture file, it's compiled by link type of file.
+type packetFilter func(ci gopacket.CaptureInfo, data []byte) bool
+
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+type captureFile struct {
+	path          string
+	firstPacket   time.Time
+	firstLinkType layers.LinkType
+
+	reader   packetReader
+	isPcapng bool
+	closers  []io.Closer
+}
+
+// Capture files of filename, filename is a file, directory or glob of rotated files, such as: '/data/dump/*.pcap.gz'.
+func captureFilenames(filename string) ([]string, error) {
+	if info, err := os.Stat(filename); nil == err {
+		if !info.IsDir() {
+			return []string{filename}, nil
+		}
+		infos, err := ioutil.ReadDir(filename)
+		if nil != err {
+			return nil, err
+		}
+		var filenames []string
+		for _, info := range infos {
+			if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+				filenames = append(filenames, filepath.Join(filename, info.Name()))
+			}
+		}
+		if len(filenames) == 0 {
+			return nil, fmt.Errorf("no capture file in dir '%s'", filename)
+		}
+		return filenames, nil
+	}
+
+	filenames, err := filepath.Glob(filename)
+	if nil != err {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("capture file '%s' not found", filename)
+	}
+	return filenames, nil
+}
+
+// Open capture file, it's pcap or pcapng, may be compressed by gzip or zstd.
+func openCaptureFile(path string) (*captureFile, error) {
+	file, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	captureFile := &captureFile{path: path, closers: []io.Closer{file}}
+
+	// step 1: decompress by magic number, not by file extension.
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, magicGzip):
+		gzipReader, err := gzip.NewReader(reader)
+		if nil != err {
+			captureFile.Close()
+			return nil, err
+		}
+		captureFile.closers = append(captureFile.closers, gzipReader)
+		reader = bufio.NewReader(gzipReader)
+	case bytes.HasPrefix(magic, magicZstd):
+		zstdReader, err := zstd.NewReader(reader)
+		if nil != err {
+			captureFile.Close()
+			return nil, err
+		}
+		captureFile.closers = append(captureFile.closers, zstdCloser{zstdReader})
+		reader = bufio.NewReader(zstdReader)
+	}
+
+	// step 2: read by capture format, pcapng may contain interfaces of different link types.
+	magic, _ = reader.Peek(4)
+	if bytes.HasPrefix(magic, magicPcapng) {
+		captureFile.isPcapng = true
+		captureFile.reader, err = pcapgo.NewNgReader(reader, pcapgo.NgReaderOptions{WantMixedLinkType: true, SkipUnknownVersion: true})
+	} else {
+		captureFile.reader, err = pcapgo.NewReader(reader)
+	}
+	if nil != err {
+		captureFile.Close()
+		return nil, fmt.Errorf("read capture file '%s' fail, cause: %v", path, err)
+	}
+	return captureFile, nil
+}
+
+// Link type of packet, pcapng file exposes link type of packet's interface.
+func (f *captureFile) linkType(ci gopacket.CaptureInfo) layers.LinkType {
+	if f.isPcapng && len(ci.AncillaryData) > 0 {
+		if linkType, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+			return linkType
+		}
+	}
+	return f.reader.LinkType()
+}
+
+func (f *captureFile) Close() {
+	for i := len(f.closers) - 1; i >= 0; i-- {
+		f.closers[i].Close()
+	}
+}
+
+// Sort rotated files by timestamp of first packet, file which has no packet is skipped.
+func sortCaptureFiles(filenames []string) []*captureFile {
+	var files []*captureFile
+	for _, filename := range filenames {
+		file, err := openCaptureFile(filename)
+		if nil != err {
+			log.Printf("[Listener] skip capture file '%s', cause: %v", filename, err)
+			continue
+		}
+		_, ci, err := file.reader.ReadPacketData()
+		file.Close()
+		if nil != err {
+			if err != io.EOF {
+				log.Printf("[Listener] skip capture file '%s', cause: %v", filename, err)
+			}
+			continue
+		}
+		files = append(files, &captureFile{path: filename, firstPacket: ci.Timestamp, firstLinkType: file.linkType(ci)})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].firstPacket.Before(files[j].firstPacket)
+	})
+	return files
+}
+
+// Read capture files in timestamp order asynchronously, packet channel is closed after all files are read.
+// bpf filter is compiled before reading, so invalid filter fails here rather than on first packet.
+func (l *Listener) readCaptureFiles(compileFilter func(linkType layers.LinkType) (packetFilter, error)) error {
+	filenames, err := captureFilenames(l.pcapFilename)
+	if nil != err {
+		return err
+	}
+	files := sortCaptureFiles(filenames)
+	if len(files) == 0 {
+		return errors.New("no packet in capture files")
+	}
+	filters := make(map[layers.LinkType]packetFilter)
+	if len(l.bpfFilter) > 0 {
+		for _, file := range files {
+			if _, ok := filters[file.firstLinkType]; ok {
+				continue
+			}
+			filter, err := compileFilter(file.firstLinkType)
+			if nil != err {
+				return fmt.Errorf("compile bpf filter '%s' fail, cause: %v", l.bpfFilter, err)
+			}
+			filters[file.firstLinkType] = filter
+		}
+	}
+
+	go func() {
+		defer close(l.receiveChan)
+		if err := l.readFiles(files, filters, compileFilter); nil != err {
+			log.Printf("[Listener] read capture files fail, cause: %v", err)
+			l.setErr(err)
+			return
+		}
+		log.Printf("[Listener] read %d capture files finished.", len(files))
+	}()
+	return nil
+}
+
+// Packets are decoded by link type of their interface, filter of link type not in filters is compiled on reading.
+func (l *Listener) readFiles(files []*captureFile, filters map[layers.LinkType]packetFilter, compileFilter func(linkType layers.LinkType) (packetFilter, error)) error {
+	for _, sorted := range files {
+		file, err := openCaptureFile(sorted.path)
+		if nil != err {
+			return err
+		}
+		for {
+			data, ci, err := file.reader.ReadPacketData()
+			if err == io.EOF {
+				break
+			}
+			if nil != err {
+				// truncated file of rotation is common, read next file, other errors fail the listener after all files read.
+				log.Printf("[Listener] read capture file '%s' fail, cause: %v", file.path, err)
+				if err != io.ErrUnexpectedEOF {
+					l.setErr(fmt.Errorf("read capture file '%s' fail, cause: %v", file.path, err))
+				}
+				break
+			}
+
+			linkType := file.linkType(ci)
+			if len(l.bpfFilter) > 0 {
+				filter, ok := filters[linkType]
+				if !ok {
+					if filter, err = compileFilter(linkType); nil != err {
+						file.Close()
+						return err
+					}
+					filters[linkType] = filter
+				}
+				if !filter(ci, data) {
+					continue
+				}
+			}
+
+			// Special case for tunnel interface
+			// See: https://github.com/google/gopacket/issues/99
+			var decoder gopacket.Decoder = linkType
+			if 12 == linkType {
+				decoder = layers.LayerTypeIPv4
+			}
+			packet := gopacket.NewPacket(data, decoder, gopacket.Default)
+			packet.Metadata().CaptureInfo = ci
+			if !l.emit(packet) {
+				file.Close()
+				return nil
+			}
+		}
+		file.Close()
+	}
+	return nil
+}
+
+// zstd decoder Close has no return value.
+type zstdCloser struct {
+	decoder *zstd.Decoder
+}
+
+func (c zstdCloser) Close() error {
+	c.decoder.Close()
+	return nil
+}
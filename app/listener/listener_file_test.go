@@ -0,0 +1,438 @@
+package listener
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const (
+	formatPcap   = "pcap"
+	formatPcapng = "pcapng"
+
+	compressNone = ""
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+var baseTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "listener-test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Ethernet tcp packet, source port identify packet.
+func testPacket(t *testing.T, srcPort int) []byte {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{0, 1, 2, 3, 4, 6}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: 80, Seq: 1, ACK: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, options, eth, ip, tcp, gopacket.Payload("GET / HTTP/1.1\r\n\r\n")); nil != err {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Write capture file, packet timestamp is baseTime + offset seconds, source port is offset.
+func writeCaptureFile(t *testing.T, path, format, compress string, offsets ...int) {
+	file, err := os.Create(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var writer io.Writer = file
+	var closer io.Closer
+	switch compress {
+	case compressGzip:
+		gzipWriter := gzip.NewWriter(file)
+		writer, closer = gzipWriter, gzipWriter
+	case compressZstd:
+		zstdWriter, err := zstd.NewWriter(file)
+		if nil != err {
+			t.Fatal(err)
+		}
+		writer, closer = zstdWriter, zstdWriter
+	}
+
+	var write func(ci gopacket.CaptureInfo, data []byte) error
+	var flush func() error
+	if format == formatPcapng {
+		ngWriter, err := pcapgo.NewNgWriter(writer, layers.LinkTypeEthernet)
+		if nil != err {
+			t.Fatal(err)
+		}
+		write, flush = ngWriter.WritePacket, ngWriter.Flush
+	} else {
+		pcapWriter := pcapgo.NewWriter(writer)
+		if err := pcapWriter.WriteFileHeader(65535, layers.LinkTypeEthernet); nil != err {
+			t.Fatal(err)
+		}
+		write = pcapWriter.WritePacket
+	}
+	for _, offset := range offsets {
+		data := testPacket(t, offset)
+		ci := gopacket.CaptureInfo{Timestamp: baseTime.Add(time.Duration(offset) * time.Second), CaptureLength: len(data), Length: len(data)}
+		if err := write(ci, data); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if nil != flush {
+		if err := flush(); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if nil != closer {
+		if err := closer.Close(); nil != err {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Source ports of packets in capture file.
+func readCaptureFile(t *testing.T, path string) []int {
+	file, err := openCaptureFile(path)
+	if nil != err {
+		t.Fatalf("open capture file fail, cause: %v", err)
+	}
+	defer file.Close()
+	var ports []int
+	for {
+		data, ci, err := file.reader.ReadPacketData()
+		if err == io.EOF {
+			return ports
+		}
+		if nil != err {
+			t.Fatalf("read capture file fail, cause: %v", err)
+		}
+		packet := gopacket.NewPacket(data, file.linkType(ci), gopacket.Default)
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		if !ok {
+			t.Fatalf("packet is not tcp: %v", packet)
+		}
+		if !ci.Timestamp.Equal(baseTime.Add(time.Duration(tcp.SrcPort) * time.Second)) {
+			t.Fatalf("packet %d timestamp is %v", tcp.SrcPort, ci.Timestamp)
+		}
+		ports = append(ports, int(tcp.SrcPort))
+	}
+}
+
+func TestOpenCaptureFile(t *testing.T) {
+	cases := []struct {
+		name     string
+		format   string
+		compress string
+	}{
+		{"pcap", formatPcap, compressNone},
+		{"pcap gzip", formatPcap, compressGzip},
+		{"pcap zstd", formatPcap, compressZstd},
+		{"pcapng", formatPcapng, compressNone},
+		{"pcapng gzip", formatPcapng, compressGzip},
+		{"pcapng zstd", formatPcapng, compressZstd},
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// file extension is misleading, format is detected by magic number.
+			path := filepath.Join(dir, "capture-"+string(rune('a'+i))+".pcap")
+			writeCaptureFile(t, path, c.format, c.compress, 1, 2, 3)
+			if ports := readCaptureFile(t, path); !reflect.DeepEqual(ports, []int{1, 2, 3}) {
+				t.Fatalf("packets expect [1 2 3], actual %v", ports)
+			}
+		})
+	}
+
+	garbage := filepath.Join(dir, "garbage.pcap")
+	ioutil.WriteFile(garbage, []byte("not a capture file"), 0644)
+	if _, err := openCaptureFile(garbage); nil == err {
+		t.Fatal("open invalid capture file expect fail")
+	}
+}
+
+func TestCaptureFilenames(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"dump.pcap", "dump.pcap.1.gz", "dump.pcap.2.zst", ".hidden"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.Mkdir(filepath.Join(dir, "empty"), 0755)
+
+	cases := []struct {
+		name     string
+		filename string
+		expects  []string // nil means error
+	}{
+		{"file", filepath.Join(dir, "dump.pcap"), []string{"dump.pcap"}},
+		{"directory skip hidden file and sub directory", dir, []string{"dump.pcap", "dump.pcap.1.gz", "dump.pcap.2.zst"}},
+		{"glob", filepath.Join(dir, "dump.pcap.*"), []string{"dump.pcap.1.gz", "dump.pcap.2.zst"}},
+		{"glob not match", filepath.Join(dir, "*.pcapng"), nil},
+		{"file not found", filepath.Join(dir, "missing.pcap"), nil},
+		{"empty directory", filepath.Join(dir, "empty"), nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			filenames, err := captureFilenames(c.filename)
+			if nil == c.expects {
+				if nil == err {
+					t.Fatalf("expect fail, actual %v", filenames)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("capture filenames fail, cause: %v", err)
+			}
+			var names []string
+			for _, filename := range filenames {
+				names = append(names, filepath.Base(filename))
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, c.expects) {
+				t.Fatalf("expect %v, actual %v", c.expects, names)
+			}
+		})
+	}
+}
+
+func TestSortCaptureFiles(t *testing.T) {
+	type testFile struct {
+		name     string
+		format   string
+		compress string
+		offsets  []int // empty file has header only
+	}
+	cases := []struct {
+		name    string
+		files   []testFile
+		expects []string
+	}{
+		{
+			name: "order by first packet rather than name",
+			files: []testFile{
+				{"a.pcap", formatPcap, compressNone, []int{30, 31}},
+				{"b.pcap", formatPcap, compressNone, []int{10, 11}},
+				{"c.pcap", formatPcap, compressNone, []int{20, 21}},
+			},
+			expects: []string{"b.pcap", "c.pcap", "a.pcap"},
+		},
+		{
+			name: "mixed format and compression",
+			files: []testFile{
+				{"dump.pcap.gz", formatPcap, compressGzip, []int{20}},
+				{"dump.pcapng.zst", formatPcapng, compressZstd, []int{10}},
+				{"dump.pcapng", formatPcapng, compressNone, []int{30}},
+			},
+			expects: []string{"dump.pcapng.zst", "dump.pcap.gz", "dump.pcapng"},
+		},
+		{
+			name: "skip empty and invalid file",
+			files: []testFile{
+				{"empty.pcap", formatPcap, compressNone, nil},
+				{"invalid.pcap", "", compressNone, nil},
+				{"valid.pcap", formatPcap, compressGzip, []int{10}},
+			},
+			expects: []string{"valid.pcap"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			var filenames []string
+			for _, file := range c.files {
+				path := filepath.Join(dir, file.name)
+				if len(file.format) == 0 {
+					ioutil.WriteFile(path, []byte("not a capture file"), 0644)
+				} else {
+					writeCaptureFile(t, path, file.format, file.compress, file.offsets...)
+				}
+				filenames = append(filenames, path)
+			}
+			var names []string
+			for _, file := range sortCaptureFiles(filenames) {
+				names = append(names, filepath.Base(file.path))
+			}
+			if !reflect.DeepEqual(names, c.expects) {
+				t.Fatalf("expect %v, actual %v", c.expects, names)
+			}
+		})
+	}
+}
+
+// Rotated files are read in order, packet channel is closed after all files are read.
+func TestReadCaptureFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeCaptureFile(t, filepath.Join(dir, "dump.pcap.1"), formatPcap, compressGzip, 3, 4)
+	writeCaptureFile(t, filepath.Join(dir, "dump.pcap.2"), formatPcapng, compressZstd, 1, 2)
+	writeCaptureFile(t, filepath.Join(dir, "dump.pcap.3"), formatPcap, compressNone, 5)
+
+	listener, err := NewListener(ReadModeOnFile, "", filepath.Join(dir, "dump.pcap.*"), "")
+	if nil != err {
+		t.Fatalf("new listener fail, cause: %v", err)
+	}
+	err = listener.readCaptureFiles(func(linkType layers.LinkType) (packetFilter, error) {
+		// filter is compiled on reading goroutine.
+		t.Error("filter is compiled without bpf filter")
+		return nil, errors.New("unexpected filter")
+	})
+	if nil != err {
+		t.Fatalf("read capture files fail, cause: %v", err)
+	}
+
+	if ports := readAllPackets(t, listener.receiveChan); !reflect.DeepEqual(ports, []int{1, 2, 3, 4, 5}) {
+		t.Fatalf("packets expect [1 2 3 4 5], actual %v", ports)
+	}
+}
+
+// Closed listener stop reading, reader is not blocked by packet channel which is not read any more.
+func TestCloseWhileReading(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeCaptureFile(t, filepath.Join(dir, "dump.pcap"), formatPcap, compressNone, 1, 2, 3, 4, 5)
+
+	listener, err := NewListener(ReadModeOnFile, "", filepath.Join(dir, "dump.pcap"), "")
+	if nil != err {
+		t.Fatalf("new listener fail, cause: %v", err)
+	}
+	packets, err := listener.Listen()
+	if nil != err {
+		t.Fatalf("listen fail, cause: %v", err)
+	}
+	<-packets
+	listener.Close()
+	listener.Close()
+
+	// reader blocked on sending next packet exit without sending it.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case packet, ok := <-packets:
+		if ok {
+			t.Fatalf("packet is sent after listener closed: %v", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet channel is not closed after listener closed")
+	}
+}
+
+// Source ports of all packets, wait packet channel closed.
+func readAllPackets(t *testing.T, packets <-chan gopacket.Packet) []int {
+	var ports []int
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case packet, ok := <-packets:
+			if !ok {
+				return ports
+			}
+			ports = append(ports, int(packet.TransportLayer().(*layers.TCP).SrcPort))
+		case <-timeout:
+			t.Fatalf("packet channel is not closed, read packets %v", ports)
+		}
+	}
+}
+
+// Filter is compiled before reading, invalid filter fail listen rather than first packet.
+func TestCompileFilterBeforeReading(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeCaptureFile(t, filepath.Join(dir, "dump.pcap.1"), formatPcap, compressNone, 1)
+	writeCaptureFile(t, filepath.Join(dir, "dump.pcap.2"), formatPcapng, compressGzip, 2)
+
+	cases := []struct {
+		name       string
+		compileErr error
+	}{
+		{"valid filter", nil},
+		{"invalid filter", errors.New("syntax error")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			listener, err := NewListener(ReadModeOnFile, "", filepath.Join(dir, "dump.pcap.*"), "tcp port 80")
+			if nil != err {
+				t.Fatalf("new listener fail, cause: %v", err)
+			}
+			var compiled []layers.LinkType
+			err = listener.readCaptureFiles(func(linkType layers.LinkType) (packetFilter, error) {
+				compiled = append(compiled, linkType)
+				return func(gopacket.CaptureInfo, []byte) bool { return true }, c.compileErr
+			})
+			if (nil != err) != (nil != c.compileErr) {
+				t.Fatalf("expect fail %v, actual error: %v", nil != c.compileErr, err)
+			}
+			// filter of each link type is compiled once, before reading.
+			if !reflect.DeepEqual(compiled, []layers.LinkType{layers.LinkTypeEthernet}) {
+				t.Fatalf("compiled link types expect [ethernet], actual %v", compiled)
+			}
+			if nil == err {
+				readAllPackets(t, listener.receiveChan)
+			}
+		})
+	}
+}
+
+// Truncated file of rotation is skipped, other read errors fail listener after all files read.
+func TestReadCaptureFilesError(t *testing.T) {
+	cases := []struct {
+		name      string
+		corrupt   func(data []byte) []byte
+		expectErr bool
+	}{
+		{"truncated file", func(data []byte) []byte { return data[:len(data)-4] }, false},
+		{"invalid packet header", func(data []byte) []byte {
+			// record header: timestamp, capture length exceeds snap length, original length.
+			header := make([]byte, 16)
+			binary.LittleEndian.PutUint32(header[8:], 1<<20)
+			binary.LittleEndian.PutUint32(header[12:], 1<<20)
+			return append(data, header...)
+		}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			writeCaptureFile(t, filepath.Join(dir, "dump.pcap.1"), formatPcap, compressNone, 1)
+			writeCaptureFile(t, filepath.Join(dir, "dump.pcap.2"), formatPcap, compressNone, 2, 3)
+			writeCaptureFile(t, filepath.Join(dir, "dump.pcap.3"), formatPcap, compressNone, 4)
+			path := filepath.Join(dir, "dump.pcap.2")
+			data, _ := ioutil.ReadFile(path)
+			ioutil.WriteFile(path, c.corrupt(data), 0644)
+
+			listener, err := NewListener(ReadModeOnFile, "", filepath.Join(dir, "dump.pcap.*"), "")
+			if nil != err {
+				t.Fatalf("new listener fail, cause: %v", err)
+			}
+			packets, err := listener.Listen()
+			if nil != err {
+				t.Fatalf("listen fail, cause: %v", err)
+			}
+			// next file is read after read error.
+			if ports := readAllPackets(t, packets); ports[len(ports)-1] != 4 {
+				t.Fatalf("last packet expect 4, actual %v", ports)
+			}
+			if (nil != listener.Err()) != c.expectErr {
+				t.Fatalf("expect error %v, actual %v", c.expectErr, listener.Err())
+			}
+		})
+	}
+}
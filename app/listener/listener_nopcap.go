@@ -0,0 +1,29 @@
+//go:build nopcap
+// +build nopcap
+
+package listener
+
+import (
+	"errors"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// Built with 'nopcap' tag, the binary is not linked with libpcap, only raw socket capture is available.
+var errPcapNotSupported = errors.New("libpcap is not supported in this build, use raw socket capture instead")
+
+func (l *Listener) openLivePcap() error {
+	return errPcapNotSupported
+}
+
+// Capture file is read without libpcap, but bpf filter can't be compiled.
+func (l *Listener) readPcapFile() error {
+	return l.readCaptureFiles(func(layers.LinkType) (packetFilter, error) {
+		return nil, errors.New("bpf filter of capture file is not supported in this build")
+	})
+}
+
+// Raw socket capture works without libpcap, but bpf filter can't be compiled.
+func compileRawSocketFilter(linkType layers.LinkType, expr string) ([]bpf.RawInstruction, error) {
+	return nil, errors.New("bpf filter of raw socket is not supported in this build, use port of raw_socket_addr instead")
+}
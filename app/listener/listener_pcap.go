@@ -0,0 +1,95 @@
+//go:build !nopcap
+// +build !nopcap
+
+package listener
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"log"
+	"net"
+	"time"
+)
+
+const livePcapReadTimeout = 100 * time.Millisecond
+
+func (l *Listener) openLivePcap() error {
+	devices, err := pcap.FindAllDevs()
+	if nil != err {
+		panic(err)
+	}
+
+	for _, device := range devices {
+		if device.Name != l.deviceName && l.deviceName != AllDevice {
+			continue
+		}
+
+		go func(ifs pcap.Interface) {
+			snapLen := int32(65535)
+			if it, err := net.InterfaceByName(ifs.Name); err == nil {
+				// auto-guess max length of packet to capture
+				snapLen = int32(it.MTU + 68*2)
+			}
+
+			// read timeout help check listener exit, handle is closed after listener closed.
+			handle, err := pcap.OpenLive(ifs.Name, snapLen, true, livePcapReadTimeout)
+			if nil != err {
+				panic(err)
+			}
+			defer handle.Close()
+
+			if len(l.bpfFilter) > 0 {
+				handle.SetBPFFilter(l.bpfFilter)
+			}
+			// Special case for tunnel interface
+			// See: https://github.com/google/gopacket/issues/99
+			var decoder gopacket.Decoder
+			if 12 == handle.LinkType() {
+				decoder = layers.LayerTypeIPv4
+			} else {
+				decoder = handle.LinkType()
+			}
+
+			packetSource := gopacket.NewPacketSource(handle, decoder)
+			for !l.isClosed() {
+				packet, err := packetSource.NextPacket()
+				if err == pcap.NextErrorTimeoutExpired {
+					continue
+				} else if nil != err {
+					log.Printf("[Listener] read device '%s' fail, cause: %v", ifs.Name, err)
+					return
+				}
+				if !l.emit(packet) {
+					return
+				}
+			}
+		}(device)
+	}
+	return nil
+}
+
+// Kernel filter of raw socket, libpcap is only used to compile it.
+func compileRawSocketFilter(linkType layers.LinkType, expr string) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(linkType, 65535, expr)
+	if nil != err {
+		return nil, err
+	}
+	filter := make([]bpf.RawInstruction, 0, len(instructions))
+	for _, ins := range instructions {
+		filter = append(filter, bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K})
+	}
+	return filter, nil
+}
+
+// Capture file is read by pcapgo, libpcap is only used to compile bpf filter.
+func (l *Listener) readPcapFile() error {
+	return l.readCaptureFiles(func(linkType layers.LinkType) (packetFilter, error) {
+		bpf, err := pcap.NewBPF(linkType, 65535, l.bpfFilter)
+		if nil != err {
+			return nil, err
+		}
+		return bpf.Matches, nil
+	})
+}
@@ -1,14 +1,29 @@
 package plugins
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"xtransform/app/common/certstore"
 	"xtransform/app/common/httphandle"
 	"xtransform/app/config"
+	"xtransform/app/service"
 )
 
 // Build a http server, listen http request.
@@ -17,8 +32,18 @@ type HttpInputPlugin struct {
 
 	msgLevel    int
 	pluginName  string
-	receiveChan chan *message
+	receiveChan chan *Message
 	httpServer  *http.Server
+	certStore   *certstore.CertStore
+
+	// handlers send message under read lock, receive channel is closed under write lock after exit.
+	mutex     sync.RWMutex
+	exit      bool
+	exitChan  chan struct{} // unblock handlers waiting for full receive queue
+	closeOnce sync.Once
+
+	// mirror mode, proxy request to primary upstream.
+	reverseProxy *httputil.ReverseProxy
 
 	IsDebug bool
 }
@@ -28,10 +53,11 @@ func NewHttpInputPlugin(config *config.HttpServerConfig) (*HttpInputPlugin, erro
 		return nil, errors.New("params is empty")
 	}
 	plugin := new(HttpInputPlugin)
-	plugin.msgLevel = msgLevelHttp
+	plugin.msgLevel = MsgLevelHttp
 	plugin.pluginName = pluginNameInputHttp
 	plugin.httpServerConfig = config
-	plugin.receiveChan = make(chan *message, 4096)
+	plugin.receiveChan = make(chan *Message, 4096)
+	plugin.exitChan = make(chan struct{})
 
 	if err := plugin.listen(); nil != err {
 		return nil, err
@@ -40,14 +66,19 @@ func NewHttpInputPlugin(config *config.HttpServerConfig) (*HttpInputPlugin, erro
 }
 
 // Read request to data, transfer to next plugin.
-func (plugin *HttpInputPlugin) GetMessage() <-chan *message {
+func (plugin *HttpInputPlugin) GetMessage() <-chan *Message {
 	return plugin.receiveChan
 }
 
-func (plugin *HttpInputPlugin) Write(msg *message) (err error) {
+func (plugin *HttpInputPlugin) Write(msg *Message) (err error) {
 	return nil
 }
 
+// Production response is attached to message in mirror mode only.
+func (plugin *HttpInputPlugin) ProvidesResponse() bool {
+	return nil != plugin.reverseProxy
+}
+
 func (plugin *HttpInputPlugin) listen() error {
 	config := plugin.httpServerConfig
 	if plugin.IsDebug {
@@ -55,33 +86,120 @@ func (plugin *HttpInputPlugin) listen() error {
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", plugin.handler)
+	if len(strings.TrimSpace(config.UpstreamUrl)) > 0 {
+		upstreamUrl, err := url.Parse(config.UpstreamUrl)
+		if nil != err {
+			return err
+		}
+		reverseProxy := httputil.NewSingleHostReverseProxy(upstreamUrl)
+		reverseProxy.ModifyResponse = plugin.mirrorResponse
+		reverseProxy.ErrorHandler = plugin.mirrorError
+		plugin.reverseProxy = reverseProxy
+		mux.HandleFunc("/", plugin.mirrorHandler)
+	} else {
+		mux.HandleFunc("/", plugin.handler)
+	}
+
+	// health check, report plugin and scheduler health.
+	if config.Healthz {
+		mux.HandleFunc(healthzPath, plugin.healthz)
+	}
+
+	// throttle request, health check is not limited.
+	var handler http.Handler = mux
+	if config.Throttle > 0 {
+		handler = newThrottleHandler(mux, config.Throttle)
+	}
+
+	// http2 over cleartext tcp, both upgrade and prior knowledge are supported.
+	if config.HTTP2 && !config.Ssl {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
 
 	httpServer := &http.Server{
 		Addr:           config.Addr + ":" + strconv.Itoa(config.Port),
-		Handler:        mux,
+		Handler:        handler,
 		ReadTimeout:    time.Duration(config.RTimeoutMs) * time.Millisecond,
 		WriteTimeout:   time.Duration(config.WTimeoutMs) * time.Millisecond,
 		IdleTimeout:    time.Duration(config.DTimeoutMs) * time.Millisecond,
 		MaxHeaderBytes: config.MaxHeaderBytes,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			connId := newConnId(conn.RemoteAddr().String(), conn.LocalAddr().String())
+			return context.WithValue(ctx, connInfoKey{}, &connInfo{id: connId})
+		},
 	}
 	plugin.httpServer = httpServer
+
+	// https support, certificate select by SNI and reload when file changed.
+	if config.Ssl {
+		var keyPairs []*certstore.KeyPair
+		if len(config.SslCert) > 0 || len(config.SslKey) > 0 {
+			keyPairs = append(keyPairs, &certstore.KeyPair{Cert: config.SslCert, Key: config.SslKey})
+		}
+		keyPairs = append(keyPairs, config.SslCerts...)
+
+		certStore, err := certstore.NewCertStore(keyPairs, config.SslClientCa, config.SslClientAuth, config.SslReloadMs)
+		if nil != err {
+			return err
+		}
+		plugin.certStore = certStore
+		httpServer.TLSConfig = certStore.TLSConfig()
+
+		// negotiate http2 by tls alpn, disable it explicitly, otherwise net/http enable it default.
+		if config.HTTP2 {
+			if err := http2.ConfigureServer(httpServer, &http2.Server{}); nil != err {
+				return err
+			}
+		} else {
+			httpServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
+
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if nil != err {
+		return err
+	}
+	// demotion, limit max connections of listener, exceed connections wait in accept queue.
+	if config.Demotion > 0 {
+		listener = netutil.LimitListener(listener, config.Demotion)
+	}
+
 	go func() {
-		err := plugin.httpServer.ListenAndServe()
-		panic(err)
+		var err error
+		if config.Ssl {
+			err = plugin.httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = plugin.httpServer.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			panic(err)
+		}
 	}()
-	log.Printf("[Http-input-plugin] http server addr '%v'", httpServer.Addr)
+	log.Printf("[Http-input-plugin] http server addr '%v', ssl: %v, http2: %v, throttle: %v, demotion: %v",
+		httpServer.Addr, config.Ssl, config.HTTP2, config.Throttle, config.Demotion)
 	return nil
 }
 
+func (plugin *HttpInputPlugin) healthz(w http.ResponseWriter, r *http.Request) {
+	healthy, status := service.HealthService.Check()
+	if healthy {
+		httphandle.WriteJsonData(w, httphandle.OK, status)
+	} else {
+		httphandle.WriteJsonStatusData(w, http.StatusServiceUnavailable, httphandle.SERVICE_UNAVAILABLE, status)
+	}
+}
+
 func (plugin *HttpInputPlugin) handler(w http.ResponseWriter, r *http.Request) {
 	// Dump request body to receive queue.
 	reqData, err := httputil.DumpRequest(r, true)
 	if nil != err {
 		httphandle.WriteJsonRaw(w, httphandle.CONFLICT, err.Error())
 	} else {
-		plugin.receiveChan <- &message{msgLevel: plugin.msgLevel, rawData: reqData, timestampNano: time.Now().UnixNano()}
-		httphandle.WriteJson(w, httphandle.OK)
+		if plugin.send(plugin.newRequestMessage(r, reqData), true) {
+			httphandle.WriteJson(w, httphandle.OK)
+		} else {
+			httphandle.WriteJsonStatus(w, http.StatusServiceUnavailable, httphandle.SERVICE_UNAVAILABLE)
+		}
 	}
 
 	if plugin.IsDebug {
@@ -89,12 +207,218 @@ func (plugin *HttpInputPlugin) handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Build http message with connection metadata of request.
+func (plugin *HttpInputPlugin) newRequestMessage(r *http.Request, reqData []byte) *Message {
+	msg := NewMessage(plugin.msgLevel, reqData, plugin.pluginName)
+	msg.SrcIp, msg.SrcPort = splitAddr(r.RemoteAddr)
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		msg.DstIp, msg.DstPort = splitAddr(addr.String())
+	}
+	if conn, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok {
+		msg.ConnId = conn.id
+		msg.ConnSeq = atomic.AddInt64(&conn.seq, 1)
+	}
+	return msg
+}
+
+// Proxy request to primary upstream, the request is transferred to next plugin after primary response finished.
+func (plugin *HttpInputPlugin) mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	// dump request before proxy, request body is buffered and restored.
+	reqData, err := httputil.DumpRequest(r, true)
+	if nil != err {
+		httphandle.WriteJsonRaw(w, httphandle.CONFLICT, err.Error())
+		return
+	}
+	msg := plugin.newRequestMessage(r, reqData)
+	ctx := context.WithValue(r.Context(), mirrorMessageKey{}, msg)
+	plugin.reverseProxy.ServeHTTP(w, r.WithContext(ctx))
+
+	if plugin.IsDebug {
+		log.Printf("Input-http-plugin mirror request: \n %v \n", string(reqData))
+	}
+}
+
+// Capture primary response body while it's copied to caller, emit message when body closed.
+func (plugin *HttpInputPlugin) mirrorResponse(res *http.Response) error {
+	msg, ok := res.Request.Context().Value(mirrorMessageKey{}).(*Message)
+	if !ok {
+		return nil
+	}
+	res.Body = &mirrorBody{ReadCloser: res.Body, response: res, msg: msg, plugin: plugin}
+	return nil
+}
+
+// Primary upstream is unavailable, the request is still replayed without primary response.
+func (plugin *HttpInputPlugin) mirrorError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[Http-input-plugin] proxy to upstream fail, cause: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+	if msg, ok := r.Context().Value(mirrorMessageKey{}).(*Message); ok {
+		plugin.emit(msg)
+	}
+}
+
+// Never block the caller of mirror mode, drop message if queue is full.
+func (plugin *HttpInputPlugin) emit(msg *Message) {
+	if !plugin.send(msg, false) {
+		log.Println("[Http-input-plugin] receive queue is full or plugin closed, drop mirror request.")
+	}
+}
+
+// Send message to receive queue, return false if plugin closed, or queue is full and block is false.
+func (plugin *HttpInputPlugin) send(msg *Message, block bool) bool {
+	plugin.mutex.RLock()
+	defer plugin.mutex.RUnlock()
+	if plugin.exit {
+		return false
+	}
+	if block {
+		select {
+		case plugin.receiveChan <- msg:
+			return true
+		case <-plugin.exitChan:
+			return false
+		}
+	}
+	select {
+	case plugin.receiveChan <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (plugin *HttpInputPlugin) GetMsgLevel() int {
+	return plugin.msgLevel
+}
+
 func (plugin *HttpInputPlugin) GetPluginName() string {
 	return plugin.pluginName
 }
 
+// help func ===========================================================================================================
+
+const healthzPath = "/-/healthz"
+
+const shutdownTimeout = 5 * time.Second // wait running handlers when plugin is closed
+
+// Connection of request, keep-alive and http2 connection has multi requests.
+type connInfoKey struct{}
+
+type connInfo struct {
+	id  string
+	seq int64
+}
+
+// Limit request rate by token bucket, burst is one second requests.
+type throttleHandler struct {
+	mutex sync.Mutex
+
+	next     http.Handler
+	interval time.Duration // time.Second / throttle
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newThrottleHandler(next http.Handler, throttle int) *throttleHandler {
+	return &throttleHandler{
+		next:     next,
+		interval: time.Second / time.Duration(throttle),
+		burst:    float64(throttle),
+		tokens:   float64(throttle),
+		last:     time.Now(),
+	}
+}
+
+func (h *throttleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != healthzPath && !h.allow() {
+		httphandle.WriteJsonStatus(w, http.StatusTooManyRequests, httphandle.TOO_MANY_REQUESTS)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *throttleHandler) allow() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	h.tokens += float64(now.Sub(h.last)) / float64(h.interval)
+	if h.tokens > h.burst {
+		h.tokens = h.burst
+	}
+	h.last = now
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// max captured primary response body size, response larger than it is not carried by message.
+const maxMirrorResponseBytes = 8 << 20
+
+type mirrorMessageKey struct{}
+
+type mirrorBody struct {
+	io.ReadCloser
+	response *http.Response
+	msg      *Message
+	plugin   *HttpInputPlugin
+
+	buf      bytes.Buffer
+	overflow bool
+	once     sync.Once
+}
+
+func (body *mirrorBody) Read(p []byte) (n int, err error) {
+	n, err = body.ReadCloser.Read(p)
+	if n > 0 && !body.overflow {
+		if body.buf.Len()+n > maxMirrorResponseBytes {
+			body.overflow = true
+			body.buf.Reset()
+		} else {
+			body.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (body *mirrorBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(func() {
+		if !body.overflow {
+			// rebuild response with buffered body, so the dump can be parsed by http.ReadResponse.
+			res := *body.response
+			res.Body = ioutil.NopCloser(bytes.NewReader(body.buf.Bytes()))
+			res.ContentLength = int64(body.buf.Len())
+			res.TransferEncoding = nil
+			if resData, err := httputil.DumpResponse(&res, true); nil == err {
+				body.msg.RawResponse = resData
+			}
+		}
+		body.plugin.emit(body.msg)
+	})
+	return err
+}
+
+// Stop handlers before receive channel closed, so no message is sent to closed channel.
 func (plugin *HttpInputPlugin) Close() {
-	plugin.httpServer.Close()
-	close(plugin.receiveChan)
-	log.Println("Close input-http-plugin finished.")
+	plugin.closeOnce.Do(func() {
+		close(plugin.exitChan)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := plugin.httpServer.Shutdown(ctx); nil != err {
+			plugin.httpServer.Close()
+		}
+		if nil != plugin.certStore {
+			plugin.certStore.Close()
+		}
+
+		plugin.mutex.Lock()
+		plugin.exit = true
+		close(plugin.receiveChan)
+		plugin.mutex.Unlock()
+		log.Println("Close input-http-plugin finished.")
+	})
 }
@@ -0,0 +1,19 @@
+package plugins
+
+import (
+	"testing"
+	"xtransform/app/config"
+)
+
+// Plugin may be closed by both reload and shutdown, second close is ignored.
+func TestHttpInputCloseTwice(t *testing.T) {
+	plugin, err := NewHttpInputPlugin(&config.HttpServerConfig{Addr: "127.0.0.1", Port: 0})
+	if nil != err {
+		t.Fatalf("new input http plugin fail, cause: %v", err)
+	}
+	plugin.Close()
+	plugin.Close()
+	if _, ok := <-plugin.GetMessage(); ok {
+		t.Fatalf("receive channel expect closed")
+	}
+}
@@ -6,35 +6,44 @@ import (
 	"errors"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"github.com/google/gopacket/reassembly"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"xtransform/app/common/tcpreader"
 	"xtransform/app/config"
 	"xtransform/app/listener"
 )
 
-// This private instance, main help process raw packet, see http stream run() function.
-var rawInputPlugin *RawInputPlugin
-
 // Read network interface card packet or raw socket packet.
 type RawInputPlugin struct {
-	rawSocketAddr string
-	deviceName    string
-	pcapFilename  string
-	bpfFilter     string
-
-	msgLevel    int
-	pluginName  string
-	receiveChan chan *message
-
-	exit    bool
-	IsDebug bool
+	rawSocketAddr     string
+	rawSocketBufferMb int
+	deviceName        string
+	pcapFilename      string
+	bpfFilter         string
+
+	assemblerOptions *tcpreader.AssemblerOptions // tcp reassembly memory limit
+
+	mutex         sync.RWMutex
+	msgLevel      int  // emitted message level, any combination of packet, tcp and http
+	fixedMsgLevel bool // message level is configured, not changed by scheduler
+	pluginName    string
+	receiveChan   chan *Message // closed after all packet sources finished
+	sources       int32         // running packet sources, only capture file source finishes
+	listeners     []*listener.Listener
+
+	exitChan  chan struct{} // closed when plugin closed, packets and messages are dropped after that
+	closeOnce sync.Once
+	IsDebug   bool
 }
 
 func NewRawInputPlugin(config *config.RawInputConfig) (*RawInputPlugin, error) {
@@ -43,27 +52,49 @@ func NewRawInputPlugin(config *config.RawInputConfig) (*RawInputPlugin, error) {
 		len(strings.TrimSpace(config.RawSocketAddr)) == 0) {
 		return nil, errors.New("invalid params")
 	}
+	msgLevel, err := parseMsgLevel(config.MsgLevels)
+	if nil != err {
+		return nil, err
+	}
+	if msgLevel&^(MsgLevelPacket|MsgLevelTcp|MsgLevelHttp) != 0 {
+		return nil, errors.New("input-raw-plugin only support packet, tcp and http message level")
+	}
 
 	plugin := &RawInputPlugin{
-		rawSocketAddr: config.RawSocketAddr,
-		deviceName:    config.DeviceName,
-		pcapFilename:  config.PcapFilename,
-		bpfFilter:     config.BpfFilter,
-
-		msgLevel:    msgLevelPacket,
-		pluginName:  pluginNameInputRaw,
-		receiveChan: make(chan *message, 4096),
-		IsDebug:     false,
+		rawSocketAddr:     config.RawSocketAddr,
+		rawSocketBufferMb: config.RawSocketBufferMb,
+		deviceName:        config.DeviceName,
+		pcapFilename:      config.PcapFilename,
+		bpfFilter:         config.BpfFilter,
+
+		assemblerOptions: tcpreader.NewAssemblerOptions(config.MaxBufferedPagesPerConn, config.MaxBufferedPagesTotal,
+			time.Duration(config.OutOfOrderTimeoutMs)*time.Millisecond, time.Duration(config.ConnectionTimeoutMs)*time.Millisecond),
+
+		msgLevel:      msgLevel,
+		fixedMsgLevel: msgLevel != 0,
+		pluginName:    pluginNameInputRaw,
+		receiveChan:   make(chan *Message, 4096),
+		exitChan:      make(chan struct{}),
+		IsDebug:       false,
+	}
+	if !plugin.fixedMsgLevel {
+		plugin.msgLevel = MsgLevelHttp // default emit http message only, until scheduler set it.
 	}
 
 	if err := plugin.listen(); nil != err {
+		plugin.Close()
 		return nil, err
 	}
-	rawInputPlugin = plugin // help process raw packet.
-	return rawInputPlugin, nil
+	return plugin, nil
 }
 
 func (plugin *RawInputPlugin) listen() (err error) {
+	for _, source := range []string{plugin.deviceName, plugin.pcapFilename, plugin.rawSocketAddr} {
+		if len(strings.TrimSpace(source)) != 0 {
+			plugin.sources++
+		}
+	}
+
 	// case 1: capture traffic on live
 	var listenerOnLive *listener.Listener
 	if len(strings.TrimSpace(plugin.deviceName)) != 0 {
@@ -72,9 +103,10 @@ func (plugin *RawInputPlugin) listen() (err error) {
 		if nil != err {
 			return err
 		}
+		plugin.listeners = append(plugin.listeners, listenerOnLive)
 
 		if receivePacketChan, err := listenerOnLive.Listen(); nil == err {
-			go plugin.processPacket(receivePacketChan)
+			go plugin.processPacket(receivePacketChan, plugin.deviceName, true)
 		} else {
 			return err
 		}
@@ -88,52 +120,105 @@ func (plugin *RawInputPlugin) listen() (err error) {
 		if nil != err {
 			return err
 		}
+		plugin.listeners = append(plugin.listeners, listenerOnPcapFile)
 		if receivePacketChan, err := listenerOnPcapFile.Listen(); nil == err {
-			go plugin.processPacket(receivePacketChan)
+			go plugin.processPacket(receivePacketChan, "", false)
 		} else {
 			return err
 		}
 	}
 
 	// case 3: capture traffic on raw socket
-	// TODO: capture raw socket
+	var listenerOnRawSocket *listener.Listener
+	if len(strings.TrimSpace(plugin.rawSocketAddr)) != 0 {
+		deviceName, portStr, err := net.SplitHostPort(plugin.rawSocketAddr)
+		if nil != err {
+			return err
+		}
+		port := 0
+		if len(portStr) > 0 {
+			if port, err = strconv.Atoi(portStr); nil != err {
+				return err
+			}
+		}
+		listenerOnRawSocket, err = listener.NewRawSocketListener(deviceName, port, plugin.bpfFilter, plugin.rawSocketBufferMb)
+		if nil != err {
+			return err
+		}
+		plugin.listeners = append(plugin.listeners, listenerOnRawSocket)
+		if receivePacketChan, err := listenerOnRawSocket.Listen(); nil == err {
+			go plugin.processPacket(receivePacketChan, deviceName, true)
+		} else {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (plugin *RawInputPlugin) processPacket(receivePacketChan <-chan gopacket.Packet) {
+// Process packets captured on iface, iface is empty if packets are read from pcap file, live is false for pcap file.
+func (plugin *RawInputPlugin) processPacket(receivePacketChan <-chan gopacket.Packet, iface string, live bool) {
 	timeout := time.Duration(50) * time.Millisecond
 	timer := time.NewTimer(timeout)
 
-	streamFactory := &customStreamFactory{}
-	streamPool := tcpassembly.NewStreamPool(streamFactory)
-	assembler := tcpassembly.NewAssembler(streamPool)
+	streamFactory := &customStreamFactory{plugin: plugin, iface: iface}
+	assembler := tcpreader.NewAssembler(streamFactory, plugin.assemblerOptions)
 
-	ticker := time.Tick(time.Minute)
+	// latest packet timestamp, flush clock of pcap file.
+	var lastPacketTime time.Time
+	ticker := time.Tick(plugin.assemblerOptions.OutOfOrderTimeout / 2)
 	for {
-		if plugin.exit {
+		select {
+		case <-plugin.exitChan:
+			// close streams, so their http parsers exit.
+			assembler.FlushAll()
 			return
-		}
+		case packet, ok := <-receivePacketChan:
+			if !ok {
+				plugin.finishSource(assembler, streamFactory)
+				return
+			}
 
-		select {
-		case packet := <-receivePacketChan:
-			// case 1: tcp, http
+			// case 1: packet
+			if plugin.isEmit(MsgLevelPacket) {
+				plugin.emit(plugin.newPacketMessage(packet, iface))
+			}
+			if !plugin.isEmit(MsgLevelTcp | MsgLevelHttp) {
+				continue
+			}
+
+			// case 2: tcp, http
 			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil || packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
 				log.Println("Unusable packet: ", packet)
 				continue
 			}
 			tcp := packet.TransportLayer().(*layers.TCP)
-			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+			ctx := &tcpreader.AssemblerContext{CaptureInfo: packet.Metadata().CaptureInfo}
+			assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, ctx)
+			if ctx.Timestamp.After(lastPacketTime) {
+				lastPacketTime = ctx.Timestamp
+			}
 
-			// case 2: udp
+			// case 3: udp
 			// TODO:
 
-			// case 3: socket
+			// case 4: socket
 			// TODO:
 
 		case <-ticker:
-			// Every minute, flush connections that haven't seen activity in the past 2 minutes.
-			assembler.FlushOlderThan(time.Now().Add(time.Minute * -2))
+			// Stop waiting out of order data after timeout, close connection which has no activity.
+			// live capture flush by wall clock, so idle connections are closed though no packet arrives,
+			// capture file is read faster than captured, flush by packet timestamp.
+			now := lastPacketTime
+			if live {
+				now = time.Now()
+			}
+			if !now.IsZero() {
+				flushed, closed := assembler.FlushWithOptions(plugin.assemblerOptions.FlushOptions(now))
+				if plugin.IsDebug {
+					log.Printf("[input-raw-plugin] flushed %d, closed %d connections.", flushed, closed)
+				}
+			}
 		default:
 			<-timer.C
 			timer.Reset(timeout)
@@ -141,71 +226,294 @@ func (plugin *RawInputPlugin) processPacket(receivePacketChan <-chan gopacket.Pa
 	}
 }
 
+// Packet source is finished, such as capture file is read. flush all connections and wait requests on them parsed,
+// message channel is closed after all packet sources finished.
+func (plugin *RawInputPlugin) finishSource(assembler *reassembly.Assembler, streamFactory *customStreamFactory) {
+	closed := assembler.FlushAll()
+	streamFactory.streams.Wait()
+	log.Printf("[input-raw-plugin] packet source finished, closed %d connections.", closed)
+	if atomic.AddInt32(&plugin.sources, -1) == 0 {
+		close(plugin.receiveChan)
+		log.Println("[input-raw-plugin] all packet sources finished.")
+	}
+}
+
+// Build packet message with addresses of network and transport layer.
+func (plugin *RawInputPlugin) newPacketMessage(packet gopacket.Packet, iface string) *Message {
+	msg := NewMessage(MsgLevelPacket, packet.Data(), plugin.pluginName)
+	msg.TimestampNano = packet.Metadata().Timestamp.UnixNano()
+	msg.Iface = iface
+	if network := packet.NetworkLayer(); nil != network {
+		msg.SrcIp, msg.DstIp = network.NetworkFlow().Src().String(), network.NetworkFlow().Dst().String()
+	}
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		msg.SrcPort, msg.DstPort = int(transport.SrcPort), int(transport.DstPort)
+	case *layers.UDP:
+		msg.SrcPort, msg.DstPort = int(transport.SrcPort), int(transport.DstPort)
+	}
+	return msg
+}
+
 func (plugin *RawInputPlugin) GetPluginName() string {
 	return plugin.pluginName
 }
 
-func (plugin *RawInputPlugin) GetMessage() <-chan *message {
+func (plugin *RawInputPlugin) GetMsgLevel() int {
+	plugin.mutex.RLock()
+	defer plugin.mutex.RUnlock()
+	return plugin.msgLevel
+}
+
+// Scheduler set message level consumed by routed output plugins, configured message level is not changed.
+func (plugin *RawInputPlugin) SetMsgLevel(msgLevel int) {
+	plugin.mutex.Lock()
+	defer plugin.mutex.Unlock()
+	if plugin.fixedMsgLevel {
+		return
+	}
+	plugin.msgLevel = msgLevel & (MsgLevelPacket | MsgLevelTcp | MsgLevelHttp)
+	log.Printf("[input-raw-plugin] emit message level: %d", plugin.msgLevel)
+}
+
+func (plugin *RawInputPlugin) isEmit(msgLevel int) bool {
+	return plugin.GetMsgLevel()&msgLevel != 0
+}
+
+func (plugin *RawInputPlugin) GetMessage() <-chan *Message {
 	return plugin.receiveChan
 }
 
-func (plugin *RawInputPlugin) Write(msg *message) (err error) {
-	if nil == msg || msg.msgLevel != plugin.msgLevel {
+func (plugin *RawInputPlugin) Write(msg *Message) (err error) {
+	if nil == msg || msg.MsgLevel&plugin.GetMsgLevel() == 0 {
 		return errors.New("invalid params")
 	}
 
-	if plugin.exit {
+	if plugin.isClosed() {
 		return errors.New("input-raw-plugin already closed")
 	}
 	//plugin.receiveChan <- msg
 	return nil
 }
 
+// Close listeners, so capture handles are closed and their readers exit.
+func (plugin *RawInputPlugin) Close() {
+	plugin.closeOnce.Do(func() {
+		close(plugin.exitChan)
+		for _, l := range plugin.listeners {
+			l.Close()
+		}
+		log.Println("Close input-raw-plugin finished.")
+	})
+}
+
+// Error of finished packet sources, such as capture file read fail.
+func (plugin *RawInputPlugin) Err() error {
+	for _, l := range plugin.listeners {
+		if err := l.Err(); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func (plugin *RawInputPlugin) isClosed() bool {
+	select {
+	case <-plugin.exitChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send message to channel, it's dropped if plugin closed, scheduler not read channel of removed plugin.
+func (plugin *RawInputPlugin) emit(msg *Message) {
+	select {
+	case plugin.receiveChan <- msg:
+	case <-plugin.exitChan:
+	}
+}
+
 // help func ===========================================================================================================
 
-// parse packet, generate http request.
-type customStreamFactory struct{}
+// parse packet, generate tcp stream segment and http request.
+type customStreamFactory struct {
+	plugin  *RawInputPlugin
+	iface   string
+	streams sync.WaitGroup // running http parser of streams
+}
 
-// httpStream will handle the actual decoding of http requests.
+// customStream emit client tcp stream segment, and handle the actual decoding of http requests.
 type customStream struct {
+	plugin           *RawInputPlugin
 	netFlow, tcpFlow gopacket.Flow
-	reader           tcpreader.ReaderStream
+	connId           string
+	srcIp, dstIp     string
+	srcPort, dstPort int
+	iface            string
+	tcpSeq, httpSeq  int64                   // sequence of emitted tcp and http message, they're emitted on different goroutine
+	msgLevel         int                     // message level emitted by this stream, decided when stream created
+	started          bool                    // client stream started by SYN or request line
+	closed           bool                    // client sent FIN or RST
+	reader           *tcpreader.ReaderStream // only exist if emit http message
 }
 
-func (factory *customStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
-	reader := tcpreader.NewReaderStream()
-	reader.LossErrors = false
+func (factory *customStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 	customStream := &customStream{
-		netFlow: netFlow,
-		tcpFlow: tcpFlow,
-		reader:  reader,
+		plugin:   factory.plugin,
+		netFlow:  netFlow,
+		tcpFlow:  tcpFlow,
+		srcIp:    netFlow.Src().String(),
+		srcPort:  int(tcp.SrcPort),
+		dstIp:    netFlow.Dst().String(),
+		dstPort:  int(tcp.DstPort),
+		iface:    factory.iface,
+		msgLevel: factory.plugin.GetMsgLevel(),
+	}
+	customStream.connId = newConnId(net.JoinHostPort(customStream.srcIp, strconv.Itoa(customStream.srcPort)),
+		net.JoinHostPort(customStream.dstIp, strconv.Itoa(customStream.dstPort)))
+	if customStream.msgLevel&MsgLevelHttp != 0 {
+		customStream.reader = tcpreader.NewReaderStream()
+		factory.streams.Add(1)
+		go func() {
+			defer factory.streams.Done()
+			customStream.run() // start process http request
+		}()
 	}
-	go customStream.run() // start process http request
-	return &customStream.reader
+	return customStream
 }
 
-func (h *customStream) run() {
-	for {
-		// payload
-		payload, err := ioutil.ReadAll(&h.reader)
+// Client stream is started by SYN, or resync on request line if capture start after connection established,
+// client packets before it are dropped, so parser never start in the middle of request. SYN-ACK is not required,
+// only client packets may be captured (such as: 'tcp dst port 80'), it's why TCPSimpleFSM is not used.
+// Client packets after FIN or RST are dropped.
+func (h *customStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if dir != reassembly.TCPDirClientToServer {
+		// server stream is not parsed, start it anyway to avoid buffering.
+		*start = true
+		return true
+	}
+	if h.closed {
+		return false
+	}
+	if !h.started {
+		if !tcp.SYN && !hasRequestLine(tcp.Payload) {
+			return false
+		}
+		h.started = true
+		*start = true
+	}
+	return true
+}
 
-		// build tcp message
-		if (nil == err || err == io.EOF) && len(payload) > 0 {
-			rawInputPlugin.receiveChan <- &message{msgLevel: msgLevelTcp, rawData: payload, timestampNano: time.Now().UnixNano()}
+// Emit client reassembled bytes as tcp message, and feed http parser.
+func (h *customStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, end, _ := sg.Info()
+	if dir != reassembly.TCPDirClientToServer {
+		return
+	}
+	if length, _ := sg.Lengths(); length > 0 {
+		// bytes of scatter gather is reused by assembler, copy it.
+		payload := make([]byte, length)
+		copy(payload, sg.Fetch(length))
+
+		if h.msgLevel&MsgLevelTcp != 0 {
+			h.tcpSeq++
+			h.plugin.emit(h.newMessage(MsgLevelTcp, payload, h.tcpSeq))
 		}
+		if nil != h.reader {
+			h.reader.Feed(payload)
+		}
+	}
+	// client sent FIN or RST, server side may be not captured, so close stream now.
+	if end {
+		h.close()
+	}
+}
+
+func (h *customStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	h.close()
+	// remove connection from pool.
+	return true
+}
 
-		// build http request
-		if request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload))); err == io.EOF {
+// Build message with client connection metadata.
+func (h *customStream) newMessage(msgLevel int, rawData []byte, connSeq int64) *Message {
+	msg := NewMessage(msgLevel, rawData, h.plugin.pluginName)
+	msg.SrcIp, msg.SrcPort = h.srcIp, h.srcPort
+	msg.DstIp, msg.DstPort = h.dstIp, h.dstPort
+	msg.Iface = h.iface
+	msg.ConnId = h.connId
+	msg.ConnSeq = connSeq
+	return msg
+}
+
+func (h *customStream) close() {
+	if h.closed {
+		return
+	}
+	h.closed = true
+	if h.msgLevel&MsgLevelTcp != 0 {
+		h.tcpSeq++
+		h.plugin.emit(h.newMessage(MsgLevelTcp, nil, h.tcpSeq))
+	}
+	if nil != h.reader {
+		h.reader.Close()
+	}
+}
+
+var httpMethods = [][]byte{[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "), []byte("HEAD "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE ")}
+
+// Payload start with http request line, such as: 'GET /index.html HTTP/1.1'.
+func hasRequestLine(payload []byte) bool {
+	for _, method := range httpMethods {
+		if !bytes.HasPrefix(payload, method) {
+			continue
+		}
+		// request line may be split into packets, check protocol version only if it's complete.
+		if index := bytes.IndexByte(payload, '\n'); index >= 0 {
+			return bytes.Contains(payload[:index], []byte(" HTTP/"))
+		}
+		return true
+	}
+	return false
+}
+
+// Parse all requests on connection, support keep-alive, pipelining, chunked body and 'Expect: 100-continue'.
+func (h *customStream) run() {
+	buf := bufio.NewReader(h.reader)
+	for {
+		request, err := http.ReadRequest(buf)
+		if err == io.EOF {
 			// We must read until we see an EOF... very important!
 			return
 		} else if err != nil {
 			log.Println("Error reading stream", h.netFlow, h.tcpFlow, ":", err)
-		} else {
-			if nil != rawInputPlugin {
-				if reqData, err := httputil.DumpRequest(request, true); nil == err {
-					rawInputPlugin.receiveChan <- &message{msgLevel: msgLevelHttp, rawData: reqData, timestampNano: time.Now().UnixNano()}
-				}
-			}
+			h.reader.Discard()
+			return
+		}
+
+		// chunked body is decoded by http.ReadRequest, read whole body before next request.
+		body, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if nil != err {
+			log.Println("Error reading request body", h.netFlow, h.tcpFlow, ":", err)
+			h.reader.Discard()
+			return
+		}
+
+		// build http request, body already sent by client, replay it with content length directly.
+		request.Header.Del("Expect")
+		request.TransferEncoding = nil
+		request.ContentLength = int64(len(body))
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if len(body) > 0 || request.Method == http.MethodPost || request.Method == http.MethodPut || request.Method == http.MethodPatch {
+			request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		if reqData, err := httputil.DumpRequest(request, true); nil == err {
+			h.httpSeq++
+			h.plugin.emit(h.newMessage(MsgLevelHttp, reqData, h.httpSeq))
 		}
 	}
 }
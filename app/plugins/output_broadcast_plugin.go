@@ -0,0 +1,238 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"xtransform/app/common/comparison"
+	"xtransform/app/common/httpclient"
+	"xtransform/app/config"
+	"xtransform/app/service"
+)
+
+// Broadcast received http request to all targets, such as current version and candidate version,
+// responses are compared between targets.
+type BroadcastOutputPlugin struct {
+	msgLevel   int
+	pluginName string
+
+	workers    int
+	targets    []*broadcastTarget
+	comparator *comparison.Comparator
+
+	queue   *messageQueue
+	pending int64 // queued and sending messages
+
+	exit bool
+}
+
+type broadcastTarget struct {
+	name       string
+	url        *url.URL
+	httpClient *httpclient.HttpClient // cookies of targets are separated
+}
+
+func NewBroadcastOutputPlugin(config *config.BroadcastOutputConfig) (*BroadcastOutputPlugin, error) {
+	if nil == config || nil == config.HttpRequestConfig {
+		return nil, errors.New("params is empty")
+	}
+	if len(config.Targets) < 2 {
+		return nil, errors.New("broadcast need at least 2 targets")
+	}
+
+	// set default value
+	if config.Workers == 0 {
+		config.Workers = runtime.NumCPU() * 2
+	}
+
+	comparator, err := comparison.New(config.Comparison)
+	if nil != err {
+		return nil, err
+	}
+
+	plugin := &BroadcastOutputPlugin{
+		msgLevel:   MsgLevelHttp,
+		pluginName: pluginNameOutputBroadcast,
+		workers:    config.Workers,
+		comparator: comparator,
+		queue:      newMessageQueue(4096),
+	}
+	names := make(map[string]bool)
+	for _, targetConfig := range config.Targets {
+		if nil == targetConfig || len(strings.TrimSpace(targetConfig.Url)) == 0 {
+			return nil, errors.New("target url is empty")
+		}
+		targetUrl, err := url.Parse(targetConfig.Url)
+		if nil != err {
+			return nil, err
+		}
+		name := targetConfig.Name
+		if len(strings.TrimSpace(name)) == 0 {
+			name = targetUrl.Host
+		}
+		if names[name] {
+			return nil, fmt.Errorf("target '%s' is configured more than once", name)
+		}
+		names[name] = true
+		httpClient, err := httpclient.NewHttpClient(config.HttpRequestConfig)
+		if nil != err {
+			return nil, err
+		}
+		plugin.targets = append(plugin.targets, &broadcastTarget{name: name, url: targetUrl, httpClient: httpClient})
+	}
+
+	go plugin.run()
+	return plugin, nil
+}
+
+func (plugin *BroadcastOutputPlugin) GetMessage() <-chan *Message {
+	return plugin.queue.C
+}
+
+func (plugin *BroadcastOutputPlugin) run() {
+	for i := 0; i < plugin.workers; i++ {
+		go plugin.productWorker()
+	}
+}
+
+func (plugin *BroadcastOutputPlugin) productWorker() {
+	timeout := time.Duration(50) * time.Millisecond
+	timer := time.NewTimer(timeout)
+
+	for {
+		if plugin.exit {
+			return
+		}
+		select {
+		case message, ok := <-plugin.queue.C:
+			if !ok {
+				return
+			}
+			if message.MsgLevel == MsgLevelHttp {
+				plugin.broadcast(message)
+			}
+			atomic.AddInt64(&plugin.pending, -1)
+		default:
+			<-timer.C
+			timer.Reset(timeout)
+		}
+	}
+}
+
+// Send request to all targets concurrently, stat responses together after all targets responded.
+func (plugin *BroadcastOutputPlugin) broadcast(msg *Message) {
+	originReq, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(msg.RawData)))
+	if nil != err {
+		log.Println(err)
+		return
+	}
+	body, err := ioutil.ReadAll(originReq.Body)
+	if nil != err {
+		log.Println(err)
+		return
+	}
+
+	entries := make([]*service.HttpStatEntry, len(plugin.targets))
+	var wg sync.WaitGroup
+	for i, target := range plugin.targets {
+		wg.Add(1)
+		go func(i int, target *broadcastTarget) {
+			defer wg.Done()
+			entries[i] = plugin.send(msg, originReq, body, target)
+		}(i, target)
+	}
+	wg.Wait()
+	service.HttpStatService.StatBroadcast(originReq.RequestURI, entries, plugin.comparator)
+}
+
+func (plugin *BroadcastOutputPlugin) send(msg *Message, originReq *http.Request, body []byte, target *broadcastTarget) *service.HttpStatEntry {
+	statEntry := &service.HttpStatEntry{MsgId: msg.Id, ConnId: msg.ConnId, ClientAddr: msg.SrcAddr(), InputPlugin: msg.InputPlugin, OutputPlugin: plugin.pluginName, Target: target.name}
+	targetUrl := resolveTargetUrl(target.url, originReq.URL)
+	statEntry.ReqUrl = targetUrl.String()
+	statEntry.StartTimeNano = time.Now().UnixNano()
+
+	req, err := http.NewRequest(originReq.Method, targetUrl.String(), bytes.NewReader(body))
+	if nil != err {
+		statEntry.Err = err
+		return statEntry
+	}
+	req.Header = originReq.Header.Clone()
+	session := target.httpClient.SessionOf(originReq, msg.SrcIp, msg.ConnId)
+	req = req.WithContext(httpclient.WithSession(req.Context(), session))
+
+	res, retries, err := target.httpClient.DoWithRetries(req)
+	statEntry.RoundTripTimeNano = time.Now().UnixNano() - statEntry.StartTimeNano
+	statEntry.Retries = retries
+	if nil != err {
+		statEntry.Err = err
+		return statEntry
+	}
+	statEntry.ResStatusCode = res.StatusCode
+	statEntry.ResHeader = res.Header
+	statEntry.ResBody = readResponseBody(res)
+	return statEntry
+}
+
+// Target url is base url, path and query of original request are appended to it,
+// such as: 'http://candidate:8080/v2' + '/users?id=1' -> 'http://candidate:8080/v2/users?id=1'.
+func resolveTargetUrl(base *url.URL, originUrl *url.URL) *url.URL {
+	result := *base
+	basePath, baseRawPath := base.Path, base.EscapedPath()
+	// request path of unix socket target is after ':', such as 'unix:///var/run/app.sock:/v2'
+	if base.Scheme == "unix" && !strings.Contains(basePath, ":") {
+		basePath, baseRawPath = basePath+":", baseRawPath+":"
+	}
+	result.Path = strings.TrimSuffix(basePath, "/") + originUrl.Path
+	result.RawPath = strings.TrimSuffix(baseRawPath, "/") + originUrl.EscapedPath()
+	switch {
+	case len(base.RawQuery) == 0:
+		result.RawQuery = originUrl.RawQuery
+	case len(originUrl.RawQuery) > 0:
+		result.RawQuery = base.RawQuery + "&" + originUrl.RawQuery
+	}
+	result.Fragment = ""
+	return &result
+}
+
+func (plugin *BroadcastOutputPlugin) Write(msg *Message) error {
+	if plugin.exit {
+		return errors.New("output-broadcast-plugin already closed")
+	}
+	if (msg.MsgLevel | plugin.msgLevel) != plugin.msgLevel {
+		return errors.New("output-broadcast-plugin message type not match")
+	}
+	atomic.AddInt64(&plugin.pending, 1)
+	if !plugin.queue.Put(msg) {
+		atomic.AddInt64(&plugin.pending, -1)
+		return errors.New("output-broadcast-plugin already closed")
+	}
+	return nil
+}
+
+func (plugin *BroadcastOutputPlugin) Pending() int {
+	return int(atomic.LoadInt64(&plugin.pending))
+}
+
+func (plugin *BroadcastOutputPlugin) GetMsgLevel() int {
+	return plugin.msgLevel
+}
+
+func (plugin *BroadcastOutputPlugin) GetPluginName() string {
+	return plugin.pluginName
+}
+
+func (plugin *BroadcastOutputPlugin) Close() {
+	plugin.exit = true
+	plugin.queue.Close()
+	log.Println("Close output-broadcast-plugin finished.")
+}
@@ -3,29 +3,40 @@ package plugins
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"errors"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
+	"xtransform/app/common/balancer"
+	"xtransform/app/common/correlation"
 	"xtransform/app/common/httpclient"
 	"xtransform/app/config"
 	"xtransform/app/service"
 )
 
+// Buffered messages of each worker.
+const workerQueueSize = 64
+
 // Redirect received http request
 type HttpOutputPlugin struct {
 	msgLevel   int
 	pluginName string
 
-	redirectUrl *url.URL
+	balancer    *balancer.Balancer
 	workers     int // it's define process worker process, default cores x 2
 	config      *httpclient.HttpRequestConfig
 	httpClient  *httpclient.HttpClient
+	correlation *correlation.Engine
 
-	receiveChan chan *message
+	queue   *messageQueue
+	pending int64 // queued and sending messages
 
 	exit    bool
 	IsDebug bool
@@ -36,7 +47,12 @@ func NewOutputHttpPlugin(config *config.HttpOutputConfig) (*HttpOutputPlugin, er
 		return nil, errors.New("params is empty")
 	}
 
-	redirectUrl, err := url.Parse(config.RedirectUrl)
+	// legacy redirect url is one of targets
+	targets := config.Targets
+	if len(strings.TrimSpace(config.RedirectUrl)) > 0 {
+		targets = append([]*balancer.Target{{Url: config.RedirectUrl}}, targets...)
+	}
+	targetBalancer, err := balancer.New(targets, config.Balancer)
 	if nil != err {
 		return nil, err
 	}
@@ -51,74 +67,125 @@ func NewOutputHttpPlugin(config *config.HttpOutputConfig) (*HttpOutputPlugin, er
 		return nil, err
 	}
 
+	correlationEngine, err := correlation.NewEngine(config.Correlations, config.HttpRequestConfig.MaxSessions)
+	if nil != err {
+		return nil, err
+	}
+
 	plugin := &HttpOutputPlugin{
-		msgLevel:    msgLevelPacket + msgLevelTcp + msgLevelHttp,
+		msgLevel:    MsgLevelHttp,
 		pluginName:  pluginNameOutputHttp,
 		workers:     config.Workers,
-		redirectUrl: redirectUrl,
+		balancer:    targetBalancer,
 		httpClient:  httpClient,
-		receiveChan: make(chan *message, 4096),
+		correlation: correlationEngine,
+		queue:       newMessageQueue(4096),
 	}
 
 	go plugin.run()
 	return plugin, nil
 }
 
-func (plugin *HttpOutputPlugin) GetMessage() <-chan *message {
-	return plugin.receiveChan
+func (plugin *HttpOutputPlugin) GetMessage() <-chan *Message {
+	return plugin.queue.C
 }
 
-func (plugin *HttpOutputPlugin) run() {
-	for i := 0; i < plugin.workers; i++ {
-		go plugin.productWorker() // http request producer
-	}
+// Http message with it's parsed request and session.
+type sessionMessage struct {
+	msg     *Message
+	req     *http.Request
+	session string
 }
 
-func (plugin *HttpOutputPlugin) productWorker() {
-	timeout := time.Duration(50) * time.Millisecond
-	timer := time.NewTimer(timeout)
+// Dispatch messages to workers, messages of same session are sent by same worker in order,
+// so cookies and correlated values of previous response are ready before next request sent.
+// Messages of shared session are kept in order of connection.
+func (plugin *HttpOutputPlugin) run() {
+	queues := make([]chan *sessionMessage, plugin.workers)
+	for i := range queues {
+		queues[i] = make(chan *sessionMessage, workerQueueSize)
+		go plugin.productWorker(queues[i]) // http request producer
+	}
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+	}()
 
-	for {
-		if plugin.exit {
-			return
+	for message := range plugin.queue.C {
+		if message.MsgLevel != MsgLevelHttp {
+			atomic.AddInt64(&plugin.pending, -1)
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewBuffer(message.RawData)))
+		if nil != err {
+			log.Println(err)
+			atomic.AddInt64(&plugin.pending, -1)
+			continue
 		}
-		select {
-		case message := <-plugin.receiveChan:
-			// case 1: send http message
-			if message.msgLevel == msgLevelHttp {
-				plugin.send(message)
-			}
-		default:
-			<-timer.C
-			timer.Reset(timeout)
+		session := plugin.httpClient.SessionOf(req, message.SrcIp, message.ConnId)
+		affinity := session
+		if len(affinity) == 0 {
+			affinity = message.ConnId
 		}
+		hash := fnv.New32a()
+		hash.Write([]byte(affinity))
+		queues[hash.Sum32()%uint32(len(queues))] <- &sessionMessage{msg: message, req: req, session: session}
 	}
 }
 
-func (plugin *HttpOutputPlugin) send(msg *message) {
-	// generate http request
-	reader := bufio.NewReader(bytes.NewBuffer(msg.rawData))
-	req, err := http.ReadRequest(reader)
+func (plugin *HttpOutputPlugin) productWorker(queue <-chan *sessionMessage) {
+	for message := range queue {
+		// messages are dropped after plugin closed.
+		if !plugin.exit {
+			plugin.send(message)
+		}
+		atomic.AddInt64(&plugin.pending, -1)
+	}
+}
+
+func (plugin *HttpOutputPlugin) send(message *sessionMessage) {
+	msg, req, session := message.msg, message.req, message.session
+	statEntry := &service.HttpStatEntry{MsgId: msg.Id, ConnId: msg.ConnId, ClientAddr: msg.SrcAddr(), InputPlugin: msg.InputPlugin, OutputPlugin: plugin.pluginName, ProdResponse: msg.RawResponse}
+
+	// pick target, request is failed if all targets are ejected.
+	target, err := plugin.balancer.Next(plugin.balancer.HashKey(req, msg.SrcIp))
 	if nil != err {
-		log.Println(err)
+		statEntry.Err = err
+		statEntry.StartTimeNano = time.Now().UnixNano()
+		service.HttpStatService.Stat(statEntry)
 		return
 	}
 
-	// set redirect url
-	req, err = http.NewRequest(req.Method, plugin.redirectUrl.String(), req.Body)
+	// set target url, path and query of original request are appended to it, keep original headers.
+	originReq := req
+	req, err = http.NewRequest(originReq.Method, resolveTargetUrl(target.Url, originReq.URL).String(), originReq.Body)
+	if nil != err {
+		log.Println(err)
+		return
+	}
+	req.Header = originReq.Header.Clone()
+	// cookies and correlated values of replay target are scoped to session of original client.
+	req = req.WithContext(httpclient.WithSession(req.Context(), session))
+	if _, err := plugin.correlation.Apply(session, req); nil != err {
+		log.Println(err)
+		return
+	}
 
-	statEntry := new(service.HttpStatEntry)
+	statEntry.ReqUrl = req.URL.String()
 	startTimeNano := time.Now().UnixNano()
-	res, err := plugin.httpClient.Do(req) // do http request
+	res, retries, err := plugin.httpClient.DoWithRetries(req) // do http request
 	endTimeNano := time.Now().UnixNano()
+	statEntry.Retries = retries
+	plugin.balancer.Report(target, nil == err && res.StatusCode < http.StatusInternalServerError)
 	if nil != err {
 		statEntry.Err = err
 	} else {
 		// stat
-		statEntry.ReqUrl = req.URL.String()
 		statEntry.ResStatusCode = res.StatusCode
-		resBody, _ := ioutil.ReadAll(res.Body)
+		resBody := readResponseBody(res)
 		statEntry.ResBody = resBody
+		plugin.correlation.Learn(session, msg.RawResponse, res.Header, resBody)
 	}
 
 	statEntry.StartTimeNano = startTimeNano
@@ -126,24 +193,54 @@ func (plugin *HttpOutputPlugin) send(msg *message) {
 	service.HttpStatService.Stat(statEntry)
 }
 
-func (plugin *HttpOutputPlugin) Write(msg *message) error {
+// Read and close response body, original request may accept gzip, then response is not decompressed by http client.
+func readResponseBody(res *http.Response) []byte {
+	defer res.Body.Close()
+	var resBodyReader io.Reader = res.Body
+	if !res.Uncompressed && strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		if gzipReader, err := gzip.NewReader(res.Body); nil == err {
+			resBodyReader = gzipReader
+		}
+	}
+	resBody, _ := ioutil.ReadAll(resBodyReader)
+	return resBody
+}
+
+func (plugin *HttpOutputPlugin) Write(msg *Message) error {
 	if plugin.exit {
 		return errors.New("output-http-plugin already closed")
 	}
 	// use xor control access, refer to linux Access Control Lists.
-	if (msg.msgLevel | plugin.msgLevel) != plugin.msgLevel {
+	if (msg.MsgLevel | plugin.msgLevel) != plugin.msgLevel {
 		return errors.New("output-http-plugin message type not match")
 	}
-	plugin.receiveChan <- msg
+	atomic.AddInt64(&plugin.pending, 1)
+	if !plugin.queue.Put(msg) {
+		atomic.AddInt64(&plugin.pending, -1)
+		return errors.New("output-http-plugin already closed")
+	}
 	return nil
 }
 
+func (plugin *HttpOutputPlugin) Pending() int {
+	return int(atomic.LoadInt64(&plugin.pending))
+}
+
+// Correlation rules learn values from production response.
+func (plugin *HttpOutputPlugin) ConsumesResponse() bool {
+	return plugin.correlation.Enabled()
+}
+
+func (plugin *HttpOutputPlugin) GetMsgLevel() int {
+	return plugin.msgLevel
+}
+
 func (plugin *HttpOutputPlugin) GetPluginName() string {
 	return plugin.pluginName
 }
 
 func (plugin *HttpOutputPlugin) Close() {
 	plugin.exit = true
-	close(plugin.receiveChan)
+	plugin.queue.Close()
 	log.Println("Close output-http-plugin finished.")
 }
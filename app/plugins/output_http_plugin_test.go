@@ -0,0 +1,103 @@
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"xtransform/app/common/correlation"
+	"xtransform/app/common/httpclient"
+	"xtransform/app/config"
+)
+
+// Token issued by login is required by next order of same session, order sent before login responded is rejected.
+func TestSessionOrder(t *testing.T) {
+	var rejected, orders int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := r.Header.Get("X-Session")
+		if r.Method == http.MethodPost {
+			time.Sleep(5 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"token":"replay-token-%s"}`, session)
+			return
+		}
+		atomic.AddInt64(&orders, 1)
+		if r.Header.Get("X-Token") != "replay-token-"+session {
+			atomic.AddInt64(&rejected, 1)
+		}
+	}))
+	defer server.Close()
+
+	plugin, err := NewOutputHttpPlugin(&config.HttpOutputConfig{
+		Workers:           8,
+		RedirectUrl:       server.URL,
+		HttpRequestConfig: &httpclient.HttpRequestConfig{TimeoutMs: 5000},
+		Correlations:      []*correlation.Rule{{Source: correlation.SourceJson, Expr: "token"}},
+	})
+	if nil != err {
+		t.Fatalf("new output http plugin fail, cause: %v", err)
+	}
+	defer plugin.Close()
+
+	const sessions = 50
+	for i := 0; i < sessions; i++ {
+		session := strconv.Itoa(i)
+		prodBody := `{"token":"prod-token-` + session + `"}`
+		login := NewMessage(MsgLevelHttp, []byte("POST /login HTTP/1.1\r\nHost: example.com\r\nX-Session: "+session+"\r\nContent-Length: 0\r\n\r\n"), "input")
+		login.SrcIp = "10.0.0." + session
+		login.RawResponse = []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(prodBody), prodBody))
+		order := NewMessage(MsgLevelHttp, []byte("GET /order HTTP/1.1\r\nHost: example.com\r\nX-Session: "+session+"\r\nX-Token: prod-token-"+session+"\r\n\r\n"), "input")
+		order.SrcIp = login.SrcIp
+		for _, msg := range []*Message{login, order} {
+			if err := plugin.Write(msg); nil != err {
+				t.Fatalf("write fail, cause: %v", err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for plugin.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages are not sent", plugin.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if orders != sessions || rejected != 0 {
+		t.Fatalf("expect %d orders with replay token, actual %d orders, %d rejected", sessions, orders, rejected)
+	}
+}
+
+// Path and query of original request are appended to target url.
+func TestHttpOutputTargetUrl(t *testing.T) {
+	uris := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uris <- r.RequestURI
+	}))
+	defer server.Close()
+
+	plugin, err := NewOutputHttpPlugin(&config.HttpOutputConfig{
+		Workers:           1,
+		RedirectUrl:       server.URL + "/v2?src=replay",
+		HttpRequestConfig: &httpclient.HttpRequestConfig{TimeoutMs: 5000},
+	})
+	if nil != err {
+		t.Fatalf("new output http plugin fail, cause: %v", err)
+	}
+	defer plugin.Close()
+
+	msg := NewMessage(MsgLevelHttp, []byte("GET /users?id=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"), "input")
+	if err := plugin.Write(msg); nil != err {
+		t.Fatalf("write fail, cause: %v", err)
+	}
+	select {
+	case uri := <-uris:
+		if uri != "/v2/users?src=replay&id=1" {
+			t.Fatalf("request uri expect '/v2/users?src=replay&id=1', actual '%s'", uri)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request is not sent")
+	}
+}
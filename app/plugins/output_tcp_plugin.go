@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,7 +15,11 @@ type TCPOutputPlugin struct {
 
 	redirectAddr string
 	workers      int // it's define process worker process, default cores x 2
-	receiveChan  chan *message
+	queue        *messageQueue
+	pending      int64 // queued and sending messages
+
+	// upstream connection of each captured connection, keep stream segments in order on same connection.
+	conns map[string]*net.TCPConn
 
 	exit    bool
 	IsDebug bool
@@ -26,10 +31,11 @@ func NewTCPOutputPlugin(addr string) (*TCPOutputPlugin, error) {
 	}
 
 	plugin := &TCPOutputPlugin{
-		msgLevel:     msgLevelTcp,
+		msgLevel:     MsgLevelTcp,
 		pluginName:   pluginNameOutputTcp,
 		redirectAddr: addr,
-		receiveChan:  make(chan *message, 4096),
+		queue:        newMessageQueue(4096),
+		conns:        make(map[string]*net.TCPConn),
 	}
 
 	go plugin.run()
@@ -51,25 +57,17 @@ func (plugin *TCPOutputPlugin) productWorker() {
 
 	for {
 		if plugin.exit {
+			plugin.closeAll()
 			return
 		}
 		select {
-		case message := <-plugin.receiveChan:
+		case message := <-plugin.queue.C:
 			// case 1: send tcp message
-			if message.msgLevel == msgLevelTcp && len(message.rawData) > 0 {
-				conn, err := net.DialTCP("tcp", nil, addr)
-				if nil != err {
-					log.Printf("[ouput-tcp-plugin] dial tcp fail, cause: %v", err.Error())
-					plugin.receiveChan <- message
-					break
-				}
-				defer conn.Close()
-
-				if _, err := conn.Write(message.rawData); nil != err {
-					plugin.receiveChan <- message
-					go plugin.productWorker() // fail retry.
-					break
-				}
+			if nil != message && message.MsgLevel == MsgLevelTcp {
+				plugin.send(addr, message)
+			}
+			if nil != message {
+				atomic.AddInt64(&plugin.pending, -1)
 			}
 		default:
 			<-timer.C
@@ -78,27 +76,82 @@ func (plugin *TCPOutputPlugin) productWorker() {
 	}
 }
 
+// Segments of same captured connection are written to same upstream connection,
+// message without connection id is written to a new connection.
+func (plugin *TCPOutputPlugin) send(addr *net.TCPAddr, msg *Message) {
+	conn, ok := plugin.conns[msg.ConnId]
+	if len(msg.RawData) == 0 {
+		// captured connection closed.
+		if ok {
+			conn.Close()
+			delete(plugin.conns, msg.ConnId)
+		}
+		return
+	}
+
+	if !ok {
+		var err error
+		if conn, err = net.DialTCP("tcp", nil, addr); nil != err {
+			log.Printf("[ouput-tcp-plugin] dial tcp fail, cause: %v", err.Error())
+			return
+		}
+		if len(msg.ConnId) > 0 {
+			plugin.conns[msg.ConnId] = conn
+		}
+	}
+
+	if _, err := conn.Write(msg.RawData); nil != err {
+		log.Printf("[ouput-tcp-plugin] write tcp fail, cause: %v", err.Error())
+		conn.Close()
+		delete(plugin.conns, msg.ConnId)
+		return
+	}
+	if len(msg.ConnId) == 0 {
+		conn.Close()
+	}
+}
+
+func (plugin *TCPOutputPlugin) closeAll() {
+	for connId, conn := range plugin.conns {
+		conn.Close()
+		delete(plugin.conns, connId)
+	}
+}
+
 func (plugin *TCPOutputPlugin) GetPluginName() string {
 	return plugin.pluginName
 }
-func (plugin *TCPOutputPlugin) GetMessage() <-chan *message {
-	return plugin.receiveChan
+
+func (plugin *TCPOutputPlugin) Pending() int {
+	return int(atomic.LoadInt64(&plugin.pending))
+}
+
+func (plugin *TCPOutputPlugin) GetMsgLevel() int {
+	return plugin.msgLevel
+}
+
+func (plugin *TCPOutputPlugin) GetMessage() <-chan *Message {
+	return plugin.queue.C
 }
 
-func (plugin *TCPOutputPlugin) Write(msg *message) (err error) {
+func (plugin *TCPOutputPlugin) Write(msg *Message) (err error) {
 	if plugin.exit {
 		return errors.New("output-tcp-plugin already closed")
 	}
 	// use xor control access, refer to linux Access Control Lists.
-	if (msg.msgLevel | plugin.msgLevel) != plugin.msgLevel {
+	if (msg.MsgLevel | plugin.msgLevel) != plugin.msgLevel {
 		return errors.New("output-tcp-plugin message type not match")
 	}
-	plugin.receiveChan <- msg
+	atomic.AddInt64(&plugin.pending, 1)
+	if !plugin.queue.Put(msg) {
+		atomic.AddInt64(&plugin.pending, -1)
+		return errors.New("output-tcp-plugin already closed")
+	}
 	return nil
 }
 
 func (plugin *TCPOutputPlugin) Close() {
 	plugin.exit = true
-	close(plugin.receiveChan)
+	plugin.queue.Close()
 	log.Println("Close output-tcp-plugin finished.")
 }
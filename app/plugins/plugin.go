@@ -1,13 +1,43 @@
 package plugins
 
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // Message Level, help plugin process different type message.
 const (
-	msgLevelPacket = 1
-	msgLevelTcp    = 2
-	msgLevelSocket = 4
-	msgLevelHttp   = 8
+	MsgLevelPacket = 1
+	MsgLevelTcp    = 2
+	MsgLevelSocket = 4
+	MsgLevelHttp   = 8
 )
 
+var msgLevelNames = map[string]int{
+	"packet": MsgLevelPacket,
+	"tcp":    MsgLevelTcp,
+	"socket": MsgLevelSocket,
+	"http":   MsgLevelHttp,
+}
+
+// Parse message level names, such as: ["tcp", "http"].
+func parseMsgLevel(names []string) (int, error) {
+	msgLevel := 0
+	for _, name := range names {
+		level, ok := msgLevelNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, errors.New("invalid message level: " + name)
+		}
+		msgLevel |= level
+	}
+	return msgLevel, nil
+}
+
 // Plugin Name, help sign all kinds of plugin.
 const (
 	pluginNameInputHttp  = "input-http-plugin"
@@ -17,18 +47,148 @@ const (
 	pluginNameOutputRaw = "output-raw-plugin"
 
 	pluginNameOutputTcp = "output-tcp-plugin"
+
+	pluginNameOutputBroadcast = "output-broadcast-plugin"
 )
 
 // Define plugin message process range, you can to set multi different range. this section refer to linux Access Control Lists.
-type message struct {
-	msgLevel      int // http : 8, socket : 4, tcp : 2, packet = 1
-	rawData       []byte
-	data          []byte
-	timestampNano int64
+type Message struct {
+	Id            string // unique message id
+	MsgLevel      int    // http : 8, socket : 4, tcp : 2, packet = 1
+	RawData       []byte
+	Data          []byte
+	RawResponse   []byte // primary upstream response dump, only exist in mirror mode
+	TimestampNano int64
+
+	// connection metadata, who sent this message.
+	SrcIp       string
+	SrcPort     int
+	DstIp       string
+	DstPort     int
+	Iface       string // capture interface name, only exist in raw capture
+	InputPlugin string // input plugin name
+
+	// tcp message is a segment of stream, segments of same connection has same ConnId.
+	// empty RawData means the connection is closed.
+	ConnId  string
+	ConnSeq int64 // sequence of same level message within connection, start from 1
+}
+
+var msgIdPrefix = strconv.FormatInt(time.Now().UnixNano(), 36)
+var msgIdCounter uint64
+
+// Build message with unique id and current timestamp, input plugin should use it to build message.
+func NewMessage(msgLevel int, rawData []byte, inputPlugin string) *Message {
+	return &Message{
+		Id:            msgIdPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&msgIdCounter, 1), 36),
+		MsgLevel:      msgLevel,
+		RawData:       rawData,
+		TimestampNano: time.Now().UnixNano(),
+		InputPlugin:   inputPlugin,
+	}
+}
+
+// Connection id is unique even if the address is reused.
+func newConnId(srcAddr, dstAddr string) string {
+	return srcAddr + "->" + dstAddr + "#" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// Split address to ip and port, such as: '10.0.0.1:5555'.
+func splitAddr(addr string) (ip string, port int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if nil != err {
+		return addr, 0
+	}
+	port, _ = strconv.Atoi(portStr)
+	return host, port
+}
+
+// Client address of message, such as: 10.0.0.1:5555, it's empty if unknown.
+func (msg *Message) SrcAddr() string {
+	if len(msg.SrcIp) == 0 {
+		return ""
+	}
+	return net.JoinHostPort(msg.SrcIp, strconv.Itoa(msg.SrcPort))
+}
+
+func (msg *Message) GetMsgLevel() int {
+	return msg.MsgLevel
 }
 
+// Plugin is implemented by input and output plugin, third-party plugin register it's factory by Register.
 type Plugin interface {
 	GetPluginName() string
-	GetMessage() <-chan *message
-	Write(msg *message) (err error)
+	GetMsgLevel() int               // input: message level emitted, output: message level accepted
+	GetMessage() <-chan *Message    // input: emitted message, closed when input finished, output: received message
+	Write(msg *Message) (err error) // output: receive message from scheduler
+	Close()
+}
+
+// Input plugin which can emit multi level message, scheduler set the level consumed by routed output plugins.
+type MsgLevelSetter interface {
+	SetMsgLevel(msgLevel int)
+}
+
+// Output plugin which send message asynchronously, scheduler wait pending messages sent before exit.
+type Drainer interface {
+	Pending() int // queued and sending messages
+}
+
+// Input plugin which may finish with error, such as capture file read fail, it's checked after input finished.
+type ErrorReporter interface {
+	Err() error
+}
+
+// Input plugin which attach production response to messages, such as http input in mirror mode.
+type ResponseProvider interface {
+	ProvidesResponse() bool
+}
+
+// Output plugin which learn from production response, such as http output with correlation rules.
+type ResponseConsumer interface {
+	ConsumesResponse() bool
+}
+
+// Message queue of output plugin, message is never sent to closed queue, blocked writer is released when it's closed.
+type messageQueue struct {
+	C chan *Message
+
+	mutex    sync.RWMutex
+	closed   bool
+	exitChan chan struct{}
+}
+
+func newMessageQueue(size int) *messageQueue {
+	return &messageQueue{C: make(chan *Message, size), exitChan: make(chan struct{})}
+}
+
+// Put message, block if queue is full, return false if queue is closed.
+func (queue *messageQueue) Put(msg *Message) bool {
+	queue.mutex.RLock()
+	defer queue.mutex.RUnlock()
+	if queue.closed {
+		return false
+	}
+	select {
+	case queue.C <- msg:
+		return true
+	case <-queue.exitChan:
+		return false
+	}
+}
+
+func (queue *messageQueue) Close() {
+	queue.mutex.Lock()
+	if queue.closed {
+		queue.mutex.Unlock()
+		return
+	}
+	queue.closed = true
+	queue.mutex.Unlock()
+	close(queue.exitChan)
+
+	// wait blocked writers released, then close channel.
+	queue.mutex.Lock()
+	close(queue.C)
+	queue.mutex.Unlock()
 }
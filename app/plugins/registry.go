@@ -0,0 +1,194 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"xtransform/app/config"
+)
+
+// Plugin kind, same plugin type can be both input and output plugin.
+const (
+	PluginKindInput  = "input"
+	PluginKindOutput = "output"
+)
+
+// Factory create plugin by config, options should be decoded by config.DecodeOptions,
+// plugin name must be config.Name.
+type Factory func(config *config.PluginConfig) (Plugin, error)
+
+var factories = struct {
+	sync.RWMutex
+	m map[string]Factory // kind/type : factory
+}{m: make(map[string]Factory)}
+
+// Register plugin factory, third-party plugin should register in it's package init func, such as:
+//
+//	func init() {
+//		plugins.Register(plugins.PluginKindOutput, "kafka", NewKafkaOutputPlugin)
+//	}
+func Register(kind, pluginType string, factory Factory) error {
+	if (kind != PluginKindInput && kind != PluginKindOutput) || len(strings.TrimSpace(pluginType)) == 0 || nil == factory {
+		return errors.New("invalid params")
+	}
+
+	factories.Lock()
+	defer factories.Unlock()
+	key := kind + "/" + pluginType
+	if _, ok := factories.m[key]; ok {
+		return fmt.Errorf("%s plugin type '%s' already registered", kind, pluginType)
+	}
+	factories.m[key] = factory
+	return nil
+}
+
+// Create plugin by registered factory of config type.
+func NewPlugin(kind string, config *config.PluginConfig) (Plugin, error) {
+	if nil == config {
+		return nil, errors.New("invalid params")
+	}
+
+	factories.RLock()
+	factory, ok := factories.m[kind+"/"+config.Type]
+	factories.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s plugin type '%s' not registered", kind, config.Type)
+	}
+
+	// factory must use configured name, scheduler find plugin by it.
+	namedConfig := *config
+	namedConfig.Name = PluginName(kind, config)
+	plugin, err := factory(&namedConfig)
+	if nil != err {
+		return nil, err
+	}
+	if plugin.GetPluginName() != namedConfig.Name {
+		plugin.Close()
+		return nil, fmt.Errorf("%s plugin type '%s' not use configured name '%s'", kind, config.Type, namedConfig.Name)
+	}
+	return plugin, nil
+}
+
+// Plugin name of config, default is '{kind}-{type}-plugin', such as: 'input-http-plugin'.
+func PluginName(kind string, config *config.PluginConfig) string {
+	if len(strings.TrimSpace(config.Name)) == 0 {
+		return kind + "-" + config.Type + "-plugin"
+	}
+	return config.Name
+}
+
+// Convert legacy plugin config fields (also set by command line flags) to registered plugin configs.
+func LegacyPluginConfigs(appConfig *config.AppConfig) (inputs, outputs []*config.PluginConfig, err error) {
+	legacy := func(pluginType string, options interface{}) *config.PluginConfig {
+		if nil != err {
+			return nil
+		}
+		var pluginConfig *config.PluginConfig
+		pluginConfig, err = config.NewPluginConfig("", pluginType, options)
+		return pluginConfig
+	}
+
+	if nil != appConfig.HttpInputPluginConfig {
+		inputs = append(inputs, legacy("http", appConfig.HttpInputPluginConfig))
+	}
+	if nil != appConfig.RawInputPluginConfig {
+		inputs = append(inputs, legacy("raw", appConfig.RawInputPluginConfig))
+	}
+	if nil != appConfig.HttpOutputPluginConfig {
+		outputs = append(outputs, legacy("http", appConfig.HttpOutputPluginConfig))
+	}
+	if len(strings.TrimSpace(appConfig.TcpOutputPluginConfig)) > 0 {
+		outputs = append(outputs, legacy("tcp", map[string]string{"addr": appConfig.TcpOutputPluginConfig}))
+	}
+	if nil != err {
+		return nil, nil, err
+	}
+	return inputs, outputs, nil
+}
+
+// Registered plugin types of kind, in sorted order.
+func RegisteredTypes(kind string) []string {
+	factories.RLock()
+	defer factories.RUnlock()
+	var types []string
+	for key := range factories.m {
+		if strings.HasPrefix(key, kind+"/") {
+			types = append(types, strings.TrimPrefix(key, kind+"/"))
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// built-in plugins ====================================================================================================
+
+func init() {
+	Register(PluginKindInput, "http", func(pluginConfig *config.PluginConfig) (Plugin, error) {
+		httpServerConfig := &config.HttpServerConfig{}
+		if err := pluginConfig.DecodeOptions(httpServerConfig); nil != err {
+			return nil, err
+		}
+		plugin, err := NewHttpInputPlugin(httpServerConfig)
+		if nil != err {
+			return nil, err
+		}
+		plugin.pluginName = pluginConfig.Name
+		return plugin, nil
+	})
+
+	Register(PluginKindInput, "raw", func(pluginConfig *config.PluginConfig) (Plugin, error) {
+		rawInputConfig := &config.RawInputConfig{}
+		if err := pluginConfig.DecodeOptions(rawInputConfig); nil != err {
+			return nil, err
+		}
+		plugin, err := NewRawInputPlugin(rawInputConfig)
+		if nil != err {
+			return nil, err
+		}
+		plugin.pluginName = pluginConfig.Name
+		return plugin, nil
+	})
+
+	Register(PluginKindOutput, "http", func(pluginConfig *config.PluginConfig) (Plugin, error) {
+		httpOutputConfig := &config.HttpOutputConfig{}
+		if err := pluginConfig.DecodeOptions(httpOutputConfig); nil != err {
+			return nil, err
+		}
+		plugin, err := NewOutputHttpPlugin(httpOutputConfig)
+		if nil != err {
+			return nil, err
+		}
+		plugin.pluginName = pluginConfig.Name
+		return plugin, nil
+	})
+
+	Register(PluginKindOutput, "broadcast", func(pluginConfig *config.PluginConfig) (Plugin, error) {
+		broadcastOutputConfig := &config.BroadcastOutputConfig{}
+		if err := pluginConfig.DecodeOptions(broadcastOutputConfig); nil != err {
+			return nil, err
+		}
+		plugin, err := NewBroadcastOutputPlugin(broadcastOutputConfig)
+		if nil != err {
+			return nil, err
+		}
+		plugin.pluginName = pluginConfig.Name
+		return plugin, nil
+	})
+
+	Register(PluginKindOutput, "tcp", func(pluginConfig *config.PluginConfig) (Plugin, error) {
+		tcpOutputConfig := &struct {
+			Addr string `yaml:"addr"`
+		}{}
+		if err := pluginConfig.DecodeOptions(tcpOutputConfig); nil != err {
+			return nil, err
+		}
+		plugin, err := NewTCPOutputPlugin(tcpOutputConfig.Addr)
+		if nil != err {
+			return nil, err
+		}
+		plugin.pluginName = pluginConfig.Name
+		return plugin, nil
+	})
+}
@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+	"xtransform/app/config"
+)
+
+const defaultConfigReloadIntervalMs = 5000
+
+// Watch config file modification, reload scheduler if it's changed.
+type ConfigWatcher struct {
+	filepath  string
+	load      func() (*config.AppConfig, error)
+	scheduler *Scheduler
+	interval  time.Duration
+	modTime   time.Time
+	exitChan  chan bool
+}
+
+// Config is loaded by load func, so command line flags can be merged in it.
+// Config file is not watched if interval is negative, reload by Reload func only, such as SIGHUP.
+func NewConfigWatcher(filepath string, load func() (*config.AppConfig, error), scheduler *Scheduler, intervalMs int) (*ConfigWatcher, error) {
+	if len(filepath) == 0 || nil == load || nil == scheduler {
+		return nil, errors.New("invalid params")
+	}
+	if intervalMs == 0 {
+		intervalMs = defaultConfigReloadIntervalMs
+	}
+	watcher := &ConfigWatcher{
+		filepath:  filepath,
+		load:      load,
+		scheduler: scheduler,
+		interval:  time.Duration(intervalMs) * time.Millisecond,
+		exitChan:  make(chan bool),
+	}
+	if info, err := os.Stat(filepath); nil == err {
+		watcher.modTime = info.ModTime()
+	}
+	if intervalMs > 0 {
+		go watcher.watch()
+	}
+	return watcher, nil
+}
+
+func (watcher *ConfigWatcher) watch() {
+	ticker := time.NewTicker(watcher.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(watcher.filepath)
+			if nil != err || !info.ModTime().After(watcher.modTime) {
+				continue
+			}
+			log.Printf("[Config-watcher] config file '%s' changed, reload it.", watcher.filepath)
+			// modification time is advanced only if reload succeeded, so failed reload is retried
+			if err := watcher.Reload(); nil == err {
+				watcher.modTime = info.ModTime()
+			}
+		case <-watcher.exitChan:
+			return
+		}
+	}
+}
+
+// Reload config, keep running config if new config is invalid.
+func (watcher *ConfigWatcher) Reload() error {
+	appConfig, err := watcher.load()
+	if nil != err {
+		log.Printf("[Config-watcher] load config fail, keep running config, cause: %v", err)
+		return err
+	}
+	summary, err := watcher.scheduler.Reload(appConfig)
+	if nil != err {
+		if nil != summary {
+			log.Printf("[Config-watcher] reload config partially applied, %s", summary)
+		}
+		log.Printf("[Config-watcher] reload config fail, cause: %v", err)
+		return err
+	}
+	log.Printf("[Config-watcher] reload config finished, %s", summary)
+	return nil
+}
+
+func (watcher *ConfigWatcher) Close() {
+	close(watcher.exitChan)
+}
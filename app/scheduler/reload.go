@@ -0,0 +1,294 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"xtransform/app/config"
+	"xtransform/app/plugins"
+)
+
+// What changed after config reloaded.
+type ReloadSummary struct {
+	AddedPlugins        []string
+	RemovedPlugins      []string
+	ReconfiguredPlugins []string // recreated with new options
+	AddedEndpoints      []string
+	RemovedEndpoints    []string
+	Warnings            []string // changes which need restart
+}
+
+func (summary *ReloadSummary) IsEmpty() bool {
+	return len(summary.AddedPlugins) == 0 && len(summary.RemovedPlugins) == 0 && len(summary.ReconfiguredPlugins) == 0 &&
+		len(summary.AddedEndpoints) == 0 && len(summary.RemovedEndpoints) == 0 && len(summary.Warnings) == 0
+}
+
+func (summary *ReloadSummary) String() string {
+	if summary.IsEmpty() {
+		return "nothing changed"
+	}
+	var changes []string
+	add := func(title string, items []string) {
+		if len(items) > 0 {
+			sort.Strings(items)
+			changes = append(changes, fmt.Sprintf("%s: [%s]", title, strings.Join(items, ", ")))
+		}
+	}
+	add("added plugins", summary.AddedPlugins)
+	add("removed plugins", summary.RemovedPlugins)
+	add("reconfigured plugins", summary.ReconfiguredPlugins)
+	add("added endpoints", summary.AddedEndpoints)
+	add("removed endpoints", summary.RemovedEndpoints)
+	add("warnings", summary.Warnings)
+	return strings.Join(changes, "; ")
+}
+
+type configuredPlugin struct {
+	kind   string
+	config *config.PluginConfig
+}
+
+type configuredEndpoint struct {
+	input  string
+	output string
+}
+
+// Apply difference between running config and new config, unaffected plugins and endpoints keep running.
+// Plugins and endpoints added by api are not in running config, they're not changed.
+func (s *Scheduler) Reload(newConfig *config.AppConfig) (*ReloadSummary, error) {
+	if nil == newConfig {
+		return nil, fmt.Errorf("invalid params")
+	}
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	// step 1: diff applied state with new config, applied state is recorded change by change,
+	// so it's still the running state if last reload failed halfway.
+	oldPlugins := make(map[string]*configuredPlugin, len(s.appliedPlugins))
+	for name, plugin := range s.appliedPlugins {
+		oldPlugins[name] = plugin
+	}
+	oldEndpoints := make(map[string]*configuredEndpoint, len(s.appliedEndpoints))
+	for id, endpoint := range s.appliedEndpoints {
+		oldEndpoints[id] = endpoint
+	}
+	newPlugins, err := configuredPlugins(newConfig)
+	if nil != err {
+		return nil, err
+	}
+	newEndpoints := configuredEndpoints(newConfig, newPlugins)
+	for id, endpoint := range newEndpoints {
+		if _, ok := newPlugins[endpoint.input]; !ok && !s.hasPlugin(endpoint.input) {
+			return nil, fmt.Errorf("route '%s' input plugin not found", id)
+		}
+		if _, ok := newPlugins[endpoint.output]; !ok && !s.hasPlugin(endpoint.output) {
+			return nil, fmt.Errorf("route '%s' output plugin not found", id)
+		}
+	}
+
+	summary := &ReloadSummary{}
+	if nil != s.config && !reflect.DeepEqual(s.config.Admin, newConfig.Admin) {
+		summary.Warnings = append(summary.Warnings, "admin config changed, restart to apply it")
+	}
+
+	// step 2: remove plugins not configured, endpoints of them are removed too.
+	for name := range oldPlugins {
+		if _, ok := newPlugins[name]; ok {
+			continue
+		}
+		if err := s.RemovePlugin(name); nil != err {
+			log.Printf("[Scheduler] reload remove plugin fail, cause: %v", err)
+		} else {
+			summary.RemovedPlugins = append(summary.RemovedPlugins, name)
+		}
+		s.unapplyPlugin(name)
+	}
+
+	// step 3: add new plugins, recreate plugins which config changed.
+	for name, newPlugin := range newPlugins {
+		oldPlugin, ok := oldPlugins[name]
+		if ok && oldPlugin.kind == newPlugin.kind && oldPlugin.config.Type == newPlugin.config.Type &&
+			reflect.DeepEqual(oldPlugin.config.Options, newPlugin.config.Options) {
+			continue
+		}
+		if ok {
+			if err := s.reconfigurePlugin(name, oldPlugin, newPlugin); nil != err {
+				return summary, fmt.Errorf("reload plugin '%s' fail, cause: %v", name, err)
+			}
+			summary.ReconfiguredPlugins = append(summary.ReconfiguredPlugins, name)
+			continue
+		}
+		if err := s.AddPluginByConfig(newPlugin.kind, newPlugin.config); nil != err {
+			return summary, fmt.Errorf("reload plugin '%s' fail, cause: %v", name, err)
+		}
+		s.appliedPlugins[name] = newPlugin
+		summary.AddedPlugins = append(summary.AddedPlugins, name)
+	}
+
+	// step 4: remove endpoints not configured, add configured endpoints which not exist,
+	// endpoints of recreated plugins are added again.
+	for id := range oldEndpoints {
+		if _, ok := newEndpoints[id]; ok {
+			continue
+		}
+		if s.hasEndpoint(id) {
+			if err := s.RemoveEndpoint(id); nil == err {
+				summary.RemovedEndpoints = append(summary.RemovedEndpoints, id)
+			}
+		}
+		delete(s.appliedEndpoints, id)
+	}
+	for id, endpoint := range newEndpoints {
+		if s.hasEndpoint(id) {
+			s.appliedEndpoints[id] = endpoint
+			continue
+		}
+		if _, err := s.AddEndpoint(endpoint.input, endpoint.output); nil != err {
+			return summary, err
+		}
+		if _, ok := oldEndpoints[id]; !ok {
+			summary.AddedEndpoints = append(summary.AddedEndpoints, id)
+		}
+		s.appliedEndpoints[id] = endpoint
+	}
+
+	s.config = newConfig
+	return summary, nil
+}
+
+// Plugins of config, plugin name : plugin config.
+func configuredPlugins(appConfig *config.AppConfig) (map[string]*configuredPlugin, error) {
+	result := make(map[string]*configuredPlugin)
+	if nil == appConfig {
+		return result, nil
+	}
+	legacyInputs, legacyOutputs, err := plugins.LegacyPluginConfigs(appConfig)
+	if nil != err {
+		return nil, err
+	}
+
+	add := func(kind string, pluginConfigs []*config.PluginConfig) error {
+		for _, pluginConfig := range pluginConfigs {
+			name := plugins.PluginName(kind, pluginConfig)
+			if _, ok := result[name]; ok {
+				return fmt.Errorf("plugin '%s' is configured more than once", name)
+			}
+			result[name] = &configuredPlugin{kind: kind, config: pluginConfig}
+		}
+		return nil
+	}
+	if err := add(plugins.PluginKindInput, append(legacyInputs, appConfig.Inputs...)); nil != err {
+		return nil, err
+	}
+	if err := add(plugins.PluginKindOutput, append(legacyOutputs, appConfig.Outputs...)); nil != err {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Endpoints of config, endpoint id : endpoint. default route all inputs to all outputs of config.
+func configuredEndpoints(appConfig *config.AppConfig, configuredPlugins map[string]*configuredPlugin) map[string]*configuredEndpoint {
+	result := make(map[string]*configuredEndpoint)
+	if nil == appConfig {
+		return result
+	}
+	if len(appConfig.Routes) > 0 {
+		for _, route := range appConfig.Routes {
+			result[endpointId(route.Input, route.Output)] = &configuredEndpoint{input: route.Input, output: route.Output}
+		}
+		return result
+	}
+	for input, in := range configuredPlugins {
+		for output, out := range configuredPlugins {
+			if in.kind == plugins.PluginKindInput && out.kind == plugins.PluginKindOutput {
+				result[endpointId(input, output)] = &configuredEndpoint{input: input, output: output}
+			}
+		}
+	}
+	return result
+}
+
+// Recreate plugin with new config, new plugin is created before old one removed, so invalid config never stop
+// running plugin. Input plugin may hold resource which new plugin need, such as listen port, it's created again
+// after old plugin removed, old plugin is restored with it's endpoints if it still fail.
+// Endpoints of new plugin are added by reload.
+func (s *Scheduler) reconfigurePlugin(name string, oldPlugin, newPlugin *configuredPlugin) error {
+	// step 1: create new plugin while old plugin is running.
+	plugin, err := plugins.NewPlugin(newPlugin.kind, newPlugin.config)
+	if nil != err && (oldPlugin.kind != plugins.PluginKindInput || newPlugin.kind != plugins.PluginKindInput) {
+		return err
+	}
+
+	// step 2: remove old plugin, it's endpoints are kept to restore it.
+	var endpoints []*configuredEndpoint
+	for _, endpoint := range s.appliedEndpoints {
+		if endpoint.input == name || endpoint.output == name {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if err := s.RemovePlugin(name); nil != err {
+		log.Printf("[Scheduler] reload remove plugin fail, cause: %v", err)
+	}
+	s.unapplyPlugin(name)
+
+	// step 3: create input plugin again after old plugin released it's resource.
+	if nil != err {
+		log.Printf("[Scheduler] create plugin '%s' fail, retry after old plugin removed, cause: %v", name, err)
+		if plugin, err = plugins.NewPlugin(newPlugin.kind, newPlugin.config); nil != err {
+			s.restorePlugin(name, oldPlugin, endpoints)
+			return err
+		}
+	}
+	if err := s.AddPlugin(newPlugin.kind, plugin); nil != err {
+		plugin.Close()
+		s.restorePlugin(name, oldPlugin, endpoints)
+		return err
+	}
+	s.appliedPlugins[name] = newPlugin
+	return nil
+}
+
+// Restore removed plugin and it's endpoints after it's new config failed.
+func (s *Scheduler) restorePlugin(name string, oldPlugin *configuredPlugin, endpoints []*configuredEndpoint) {
+	if err := s.AddPluginByConfig(oldPlugin.kind, oldPlugin.config); nil != err {
+		log.Printf("[Scheduler] restore plugin '%s' fail, cause: %v", name, err)
+		return
+	}
+	s.appliedPlugins[name] = oldPlugin
+	for _, endpoint := range endpoints {
+		id := endpointId(endpoint.input, endpoint.output)
+		if _, err := s.AddEndpoint(endpoint.input, endpoint.output); nil != err {
+			log.Printf("[Scheduler] restore endpoint '%s' fail, cause: %v", id, err)
+			continue
+		}
+		s.appliedEndpoints[id] = endpoint
+	}
+	log.Printf("[Scheduler] plugin '%s' is restored with old config.", name)
+}
+
+// Plugin is removed, endpoints of it are removed too.
+func (s *Scheduler) unapplyPlugin(name string) {
+	delete(s.appliedPlugins, name)
+	for id, endpoint := range s.appliedEndpoints {
+		if endpoint.input == name || endpoint.output == name {
+			delete(s.appliedEndpoints, id)
+		}
+	}
+}
+
+func (s *Scheduler) hasPlugin(name string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, isInput := s.inputPlugins[name]
+	_, isOutput := s.outputPlugins[name]
+	return isInput || isOutput
+}
+
+func (s *Scheduler) hasEndpoint(id string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.endpoints[id]
+	return ok
+}
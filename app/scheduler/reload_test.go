@@ -0,0 +1,328 @@
+package scheduler
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"xtransform/app/config"
+	"xtransform/app/plugins"
+)
+
+const testPluginType = "reload-test"
+
+// Ports held by running test plugins, like listen port of http input plugin.
+var testPorts = struct {
+	sync.Mutex
+	held map[int]bool
+}{held: make(map[int]bool)}
+
+// Plugin of test, factory fail if option 'fail' is true, or option 'port' is held by another plugin.
+type testPlugin struct {
+	name        string
+	port        int
+	err         error // error reported after input finished
+	receiveChan chan *plugins.Message
+}
+
+func newTestPlugin(pluginConfig *config.PluginConfig) (plugins.Plugin, error) {
+	if fail, _ := pluginConfig.Options["fail"].(bool); fail {
+		return nil, errors.New("create plugin fail")
+	}
+	port, _ := pluginConfig.Options["port"].(int)
+	if port > 0 {
+		testPorts.Lock()
+		defer testPorts.Unlock()
+		if testPorts.held[port] {
+			return nil, errors.New("port already in use")
+		}
+		testPorts.held[port] = true
+	}
+	plugin := &testPlugin{name: pluginConfig.Name, port: port, receiveChan: make(chan *plugins.Message)}
+	if err, _ := pluginConfig.Options["err"].(string); len(err) > 0 {
+		plugin.err = errors.New(err)
+	}
+	return plugin, nil
+}
+
+func (plugin *testPlugin) GetPluginName() string                  { return plugin.name }
+func (plugin *testPlugin) GetMsgLevel() int                       { return plugins.MsgLevelHttp }
+func (plugin *testPlugin) GetMessage() <-chan *plugins.Message    { return plugin.receiveChan }
+func (plugin *testPlugin) Write(msg *plugins.Message) (err error) { return nil }
+func (plugin *testPlugin) Err() error                             { return plugin.err }
+
+func (plugin *testPlugin) Close() {
+	testPorts.Lock()
+	defer testPorts.Unlock()
+	delete(testPorts.held, plugin.port)
+}
+
+func init() {
+	plugins.Register(plugins.PluginKindInput, testPluginType, newTestPlugin)
+	plugins.Register(plugins.PluginKindOutput, testPluginType, newTestPlugin)
+}
+
+// plugin name : options, nil options is created with empty options.
+type testPlugins map[string]map[string]interface{}
+
+func newTestConfig(inputs, outputs testPlugins, routes ...string) *config.AppConfig {
+	appConfig := &config.AppConfig{}
+	for name, options := range inputs {
+		appConfig.Inputs = append(appConfig.Inputs, &config.PluginConfig{Name: name, Type: testPluginType, Options: options})
+	}
+	for name, options := range outputs {
+		appConfig.Outputs = append(appConfig.Outputs, &config.PluginConfig{Name: name, Type: testPluginType, Options: options})
+	}
+	for i := 0; i+1 < len(routes); i += 2 {
+		appConfig.Routes = append(appConfig.Routes, &config.RouteConfig{Input: routes[i], Output: routes[i+1]})
+	}
+	return appConfig
+}
+
+func withAdmin(appConfig *config.AppConfig) *config.AppConfig {
+	appConfig.Admin = &config.AdminConfig{Port: 8081}
+	return appConfig
+}
+
+func sorted(items []string) []string {
+	result := append([]string{}, items...)
+	sort.Strings(result)
+	return result
+}
+
+func runningEndpoints(s *Scheduler) []string {
+	var ids []string
+	for _, endpoint := range s.Endpoints() {
+		ids = append(ids, endpoint.Id)
+	}
+	return sorted(ids)
+}
+
+func runningPlugins(s *Scheduler) []string {
+	var names []string
+	for _, kind := range []string{plugins.PluginKindInput, plugins.PluginKindOutput} {
+		for _, plugin := range s.Plugins(kind) {
+			names = append(names, plugin.GetPluginName())
+		}
+	}
+	return sorted(names)
+}
+
+func assertItems(t *testing.T, title string, expect, actual []string) {
+	if len(expect) == 0 && len(actual) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(sorted(expect), sorted(actual)) {
+		t.Fatalf("%s expect %v, actual %v", title, sorted(expect), sorted(actual))
+	}
+}
+
+func TestReloadDiff(t *testing.T) {
+	v1 := map[string]interface{}{"version": 1}
+	v2 := map[string]interface{}{"version": 2}
+	cases := []struct {
+		name       string
+		oldConfig  *config.AppConfig
+		newConfig  *config.AppConfig
+		added      []string
+		removed    []string
+		reconfig   []string
+		addedEp    []string
+		removedEp  []string
+		plugins    []string
+		endpoints  []string
+		emptyDiff  bool
+		hasWarning bool
+	}{
+		{
+			name:      "add plugins to empty scheduler",
+			oldConfig: &config.AppConfig{},
+			newConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil}),
+			added:     []string{"in", "out"},
+			addedEp:   []string{"in->out"},
+			plugins:   []string{"in", "out"},
+			endpoints: []string{"in->out"},
+		},
+		{
+			name:      "nothing changed",
+			oldConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": v1}),
+			newConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": v1}),
+			plugins:   []string{"in", "out"},
+			endpoints: []string{"in->out"},
+			emptyDiff: true,
+		},
+		{
+			name:      "remove output and it's endpoints",
+			oldConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil, "out2": nil}),
+			newConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil}),
+			removed:   []string{"out2"},
+			plugins:   []string{"in", "out"},
+			endpoints: []string{"in->out"},
+		},
+		{
+			name:      "recreate plugin which options changed, endpoints are added again",
+			oldConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": v1}),
+			newConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": v2}),
+			reconfig:  []string{"out"},
+			plugins:   []string{"in", "out"},
+			endpoints: []string{"in->out"},
+		},
+		{
+			name:      "routes changed",
+			oldConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil, "out2": nil}, "in", "out"),
+			newConfig: newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil, "out2": nil}, "in", "out2"),
+			addedEp:   []string{"in->out2"},
+			removedEp: []string{"in->out"},
+			plugins:   []string{"in", "out", "out2"},
+			endpoints: []string{"in->out2"},
+		},
+		{
+			name:       "admin change need restart",
+			oldConfig:  newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil}),
+			newConfig:  withAdmin(newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil})),
+			plugins:    []string{"in", "out"},
+			endpoints:  []string{"in->out"},
+			hasWarning: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewScheduler()
+			defer s.Close()
+			if err := s.Init(c.oldConfig); nil != err {
+				t.Fatalf("init fail, cause: %v", err)
+			}
+			summary, err := s.Reload(c.newConfig)
+			if nil != err {
+				t.Fatalf("reload fail, cause: %v", err)
+			}
+			assertItems(t, "added plugins", c.added, summary.AddedPlugins)
+			assertItems(t, "removed plugins", c.removed, summary.RemovedPlugins)
+			assertItems(t, "reconfigured plugins", c.reconfig, summary.ReconfiguredPlugins)
+			assertItems(t, "added endpoints", c.addedEp, summary.AddedEndpoints)
+			assertItems(t, "removed endpoints", c.removedEp, summary.RemovedEndpoints)
+			assertItems(t, "running plugins", c.plugins, runningPlugins(s))
+			assertItems(t, "running endpoints", c.endpoints, runningEndpoints(s))
+			if summary.IsEmpty() != c.emptyDiff {
+				t.Fatalf("empty summary expect %v, actual %v: %s", c.emptyDiff, summary.IsEmpty(), summary)
+			}
+			if (len(summary.Warnings) > 0) != c.hasWarning {
+				t.Fatalf("warning expect %v, actual %v", c.hasWarning, summary.Warnings)
+			}
+		})
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	cases := []struct {
+		name      string
+		newConfig *config.AppConfig
+	}{
+		{"route input not found", newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil}, "missing", "out")},
+		{"route output not found", newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil}, "in", "missing")},
+		{"plugin configured more than once", newTestConfig(testPlugins{"in": nil}, testPlugins{"in": nil})},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewScheduler()
+			defer s.Close()
+			if err := s.Init(newTestConfig(testPlugins{"in": nil}, testPlugins{"out": nil})); nil != err {
+				t.Fatalf("init fail, cause: %v", err)
+			}
+			if _, err := s.Reload(c.newConfig); nil == err {
+				t.Fatal("reload expect fail")
+			}
+			// invalid config is rejected before any change.
+			assertItems(t, "running plugins", []string{"in", "out"}, runningPlugins(s))
+			assertItems(t, "running endpoints", []string{"in->out"}, runningEndpoints(s))
+		})
+	}
+}
+
+func runningPlugin(s *Scheduler, name string) plugins.Plugin {
+	for _, kind := range []string{plugins.PluginKindInput, plugins.PluginKindOutput} {
+		for _, plugin := range s.Plugins(kind) {
+			if plugin.GetPluginName() == name {
+				return plugin
+			}
+		}
+	}
+	return nil
+}
+
+func TestReconfigurePlugin(t *testing.T) {
+	cases := []struct {
+		name       string
+		oldConfig  *config.AppConfig
+		newConfig  *config.AppConfig
+		plugin     string // reconfigured plugin
+		expectFail bool
+		expectSame bool // old plugin instance keep running
+	}{
+		{
+			name:       "invalid output config keep old output running",
+			oldConfig:  newTestConfig(testPlugins{"in": nil}, testPlugins{"out": {"version": 1}}),
+			newConfig:  newTestConfig(testPlugins{"in": nil}, testPlugins{"out": {"fail": true}}),
+			plugin:     "out",
+			expectFail: true,
+			expectSame: true,
+		},
+		{
+			name:       "output held port is not released for new output",
+			oldConfig:  newTestConfig(testPlugins{"in": nil}, testPlugins{"out": {"port": 9001, "version": 1}}),
+			newConfig:  newTestConfig(testPlugins{"in": nil}, testPlugins{"out": {"port": 9001, "version": 2}}),
+			plugin:     "out",
+			expectFail: true,
+			expectSame: true,
+		},
+		{
+			name:      "input created again after old input released port",
+			oldConfig: newTestConfig(testPlugins{"in": {"port": 9002, "version": 1}}, testPlugins{"out": nil}),
+			newConfig: newTestConfig(testPlugins{"in": {"port": 9002, "version": 2}}, testPlugins{"out": nil}),
+			plugin:    "in",
+		},
+		{
+			name:       "invalid input config restore old input",
+			oldConfig:  newTestConfig(testPlugins{"in": {"port": 9003}}, testPlugins{"out": nil}),
+			newConfig:  newTestConfig(testPlugins{"in": {"port": 9003, "fail": true}}, testPlugins{"out": nil}),
+			plugin:     "in",
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := NewScheduler()
+			defer s.Close()
+			if err := s.Init(c.oldConfig); nil != err {
+				t.Fatalf("init fail, cause: %v", err)
+			}
+			oldPlugin := runningPlugin(s, c.plugin)
+			defer func() {
+				for _, name := range runningPlugins(s) {
+					s.RemovePlugin(name)
+				}
+			}()
+
+			_, err := s.Reload(c.newConfig)
+			if (nil != err) != c.expectFail {
+				t.Fatalf("reload expect fail %v, actual error: %v", c.expectFail, err)
+			}
+			// plugin and it's endpoints are running whether reconfigured or not.
+			assertItems(t, "running plugins", []string{"in", "out"}, runningPlugins(s))
+			assertItems(t, "running endpoints", []string{"in->out"}, runningEndpoints(s))
+			if same := runningPlugin(s, c.plugin) == oldPlugin; same != c.expectSame {
+				t.Fatalf("old plugin keep running expect %v, actual %v", c.expectSame, same)
+			}
+
+			// next reload diff with running plugin, old config is nothing changed.
+			summary, err := s.Reload(c.oldConfig)
+			if nil != err {
+				t.Fatalf("reload old config fail, cause: %v", err)
+			}
+			if c.expectFail != summary.IsEmpty() {
+				t.Fatalf("reload old config after failed reload expect nothing changed, actual %s", summary)
+			}
+		})
+	}
+}
@@ -2,11 +2,15 @@ package scheduler
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 	"xtransform/app/config"
 	"xtransform/app/plugins"
+	"xtransform/app/service"
 )
 
 const Forever = -time.Millisecond * 10
@@ -14,110 +18,372 @@ const Forever = -time.Millisecond * 10
 // Register all plugins and write input-plugin traffic to output-plugin.
 type Scheduler struct {
 	mutex         sync.RWMutex
-	inputPlugins  []plugins.Plugin
-	outputPlugins []plugins.Plugin
-	endpoints     map[int64]*Endpoint // timestamp nanosecond : endpoint
+	inputPlugins  map[string]plugins.Plugin // plugin name : input plugin
+	outputPlugins map[string]plugins.Plugin // plugin name : output plugin
+	pausedPlugins map[string]bool           // plugin name : paused
+	endpoints     map[string]*Endpoint      // endpoint id : endpoint
+	transforms    map[plugins.Plugin]bool   // input plugin which traffic is transforming
+	finished      map[string]bool           // input plugin name : finished, such as capture file is read
+	failedInputs  map[string]error          // input plugin name : error, input plugin finished with error
+	finishedChan  chan struct{}             // closed when all input plugins finished
+	finishOnce    sync.Once
+	reloadMutex   sync.Mutex
+	config        *config.AppConfig // last applied config, plugins and endpoints added by api are not in it
+	stopped       bool              // replay stopped, traffic of all input plugins is dropped
 	exit          bool
+
+	// plugins and endpoints applied by reload, recorded change by change, so they're right after failed reload
+	appliedPlugins   map[string]*configuredPlugin
+	appliedEndpoints map[string]*configuredEndpoint
 }
 
 // Input-plugin with Output-plugin relationship is N to M.
 // Endpoint is a middle relationship, help maintain input and output.
 type Endpoint struct {
-	Input       plugins.Plugin
-	Output      plugins.Plugin
-	timeoutNano int64
+	Id     string // stable id, such as: 'input-raw-plugin->output-http-plugin'
+	Input  plugins.Plugin
+	Output plugins.Plugin
+	Paused bool // paused endpoint drop traffic of input
 }
 
 func NewScheduler() *Scheduler {
 	scheduler := &Scheduler{
-		mutex:     sync.RWMutex{},
-		endpoints: make(map[int64]*Endpoint),
-		exit:      false,
+		mutex:         sync.RWMutex{},
+		inputPlugins:  make(map[string]plugins.Plugin),
+		outputPlugins: make(map[string]plugins.Plugin),
+		pausedPlugins: make(map[string]bool),
+		endpoints:     make(map[string]*Endpoint),
+		transforms:    make(map[plugins.Plugin]bool),
+		finished:      make(map[string]bool),
+		failedInputs:  make(map[string]error),
+		finishedChan:  make(chan struct{}),
+		exit:          false,
+
+		appliedPlugins:   make(map[string]*configuredPlugin),
+		appliedEndpoints: make(map[string]*configuredEndpoint),
 	}
 	return scheduler
 }
 
+// Init plugins and endpoints of config, it's same as reload config on empty scheduler.
 func (s *Scheduler) Init(config *config.AppConfig) error {
-	// case 1: init http input plugin
-	if nil != config.HttpInputPluginConfig {
-		httpInputPlugin, err := plugins.NewHttpInputPlugin(config.HttpInputPluginConfig)
-		if nil != err {
-			log.Println(err)
-			return err
-		}
-		s.inputPlugins = append(s.inputPlugins, httpInputPlugin)
+	summary, err := s.Reload(config)
+	if nil != err {
+		log.Println(err)
+		return err
 	}
+	log.Printf("Scheduler init plugin finished, %s", summary)
+	s.registerHealthChecker()
+	log.Print("Scheduler start service ...")
+	return nil
+}
 
-	// case 2: init http output plugin
-	if nil != config.HttpOutputPluginConfig {
-		httpOutputPlugin, err := plugins.NewOutputHttpPlugin(config.HttpOutputPluginConfig)
-		if nil != err {
-			return err
+// Input plugin emit only message level consumed by it's routed output plugins.
+func (s *Scheduler) setInputMsgLevel() {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, in := range s.inputPlugins {
+		setter, ok := in.(plugins.MsgLevelSetter)
+		if !ok {
+			continue
 		}
-		s.outputPlugins = append(s.outputPlugins, httpOutputPlugin)
+		msgLevel := 0
+		for _, endpoint := range s.endpoints {
+			if endpoint.Input == in {
+				msgLevel |= endpoint.Output.GetMsgLevel()
+			}
+		}
+		setter.SetMsgLevel(msgLevel)
 	}
+}
 
-	// case 3: init raw packet input plugin
-	if nil != config.RawInputPluginConfig {
-		rawInputPlugin, err := plugins.NewRawInputPlugin(config.RawInputPluginConfig)
-		if nil != err {
-			return err
+// Scheduler is healthy if it's running with endpoints.
+func (s *Scheduler) registerHealthChecker() {
+	service.HealthService.Register("scheduler", func() error {
+		if s.exit {
+			return errors.New("scheduler already closed")
 		}
-		s.inputPlugins = append(s.inputPlugins, rawInputPlugin)
-	}
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		if len(s.endpoints) == 0 {
+			return errors.New("no endpoint registered")
+		}
+		return nil
+	})
+}
 
-	// case 4: init tcp output plugin
-	if "" != config.TcpOutputPluginConfig {
-		tcpOutputPlugin, err := plugins.NewTCPOutputPlugin(config.TcpOutputPluginConfig)
-		if nil != err {
-			return err
+// Plugin is healthy if it's message queue is not full.
+func (s *Scheduler) registerPluginHealthChecker(plugin plugins.Plugin) {
+	queue := plugin.GetMessage()
+	service.HealthService.Register(plugin.GetPluginName(), func() error {
+		if cap(queue) > 0 && len(queue) >= cap(queue) {
+			return fmt.Errorf("message queue is full, size %d", len(queue))
 		}
-		s.outputPlugins = append(s.outputPlugins, tcpOutputPlugin)
+		return nil
+	})
+}
+
+// Add running plugin, plugin name must be unique in all plugins.
+func (s *Scheduler) AddPlugin(kind string, plugin plugins.Plugin) error {
+	if nil == plugin || len(strings.TrimSpace(plugin.GetPluginName())) == 0 {
+		return errors.New("invalid params")
+	}
+	if s.exit {
+		return errors.New("Scheduler already closed")
 	}
 
-	log.Print("Scheduler init plugin finished, start register plugin ...")
-	for _, in := range s.inputPlugins {
-		for _, out := range s.outputPlugins {
-			endpoint := &Endpoint{Input: in, Output: out, timeoutNano: time.Now().UnixNano()}
-			s.RegisterEndpoint(endpoint)
-			log.Printf("Register Endpoint (Input-Plugin: %s, Output-Plugin: %s) \n", in.GetPluginName(), out.GetPluginName())
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := plugin.GetPluginName()
+	_, isInput := s.inputPlugins[name]
+	_, isOutput := s.outputPlugins[name]
+	if isInput || isOutput {
+		return fmt.Errorf("plugin '%s' already exist", name)
+	}
+	switch kind {
+	case plugins.PluginKindInput:
+		s.inputPlugins[name] = plugin
+	case plugins.PluginKindOutput:
+		s.outputPlugins[name] = plugin
+	default:
+		return fmt.Errorf("invalid plugin kind '%s'", kind)
+	}
+	s.registerPluginHealthChecker(plugin)
+	log.Printf("Register Plugin (%s: %s) \n", kind, name)
+	return nil
+}
+
+// Create plugin by registered factory and add it.
+func (s *Scheduler) AddPluginByConfig(kind string, pluginConfig *config.PluginConfig) error {
+	plugin, err := plugins.NewPlugin(kind, pluginConfig)
+	if nil != err {
+		return err
+	}
+	if err := s.AddPlugin(kind, plugin); nil != err {
+		plugin.Close()
+		return err
+	}
+	return nil
+}
+
+// Remove plugin and it's endpoints, plugin is closed after removed.
+func (s *Scheduler) RemovePlugin(name string) error {
+	s.mutex.Lock()
+	plugin, ok := s.inputPlugins[name]
+	if !ok {
+		plugin, ok = s.outputPlugins[name]
+	}
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("plugin '%s' not found", name)
+	}
+	for id, endpoint := range s.endpoints {
+		if endpoint.Input == plugin || endpoint.Output == plugin {
+			delete(s.endpoints, id)
+			log.Printf("Unregister Endpoint %s \n", id)
 		}
 	}
-	log.Print("Scheduler start service ...")
+	delete(s.inputPlugins, name)
+	delete(s.outputPlugins, name)
+	delete(s.pausedPlugins, name)
+	delete(s.transforms, plugin)
+	delete(s.finished, name)
+	delete(s.failedInputs, name)
+	s.mutex.Unlock()
+
+	service.HealthService.Unregister(name)
+	plugin.Close()
+	s.setInputMsgLevel()
+	log.Printf("Unregister Plugin %s \n", name)
 	return nil
 }
 
+// Paused input plugin drop it's traffic, paused output plugin receive nothing.
+func (s *Scheduler) PausePlugin(name string) error {
+	return s.setPluginPaused(name, true)
+}
+
+func (s *Scheduler) ResumePlugin(name string) error {
+	return s.setPluginPaused(name, false)
+}
+
+func (s *Scheduler) setPluginPaused(name string, paused bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, isInput := s.inputPlugins[name]
+	_, isOutput := s.outputPlugins[name]
+	if !isInput && !isOutput {
+		return fmt.Errorf("plugin '%s' not found", name)
+	}
+	if paused {
+		s.pausedPlugins[name] = true
+	} else {
+		delete(s.pausedPlugins, name)
+	}
+	return nil
+}
+
+func (s *Scheduler) IsPluginPaused(name string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.pausedPlugins[name]
+}
+
+// Plugins of kind, in name order.
+func (s *Scheduler) Plugins(kind string) []plugins.Plugin {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	pluginMap := s.inputPlugins
+	if kind == plugins.PluginKindOutput {
+		pluginMap = s.outputPlugins
+	}
+	names := make([]string, 0, len(pluginMap))
+	for name := range pluginMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]plugins.Plugin, 0, len(names))
+	for _, name := range names {
+		result = append(result, pluginMap[name])
+	}
+	return result
+}
+
+// Route traffic of input plugin to output plugin, both plugins must be added.
+func (s *Scheduler) AddEndpoint(inputName, outputName string) (*Endpoint, error) {
+	s.mutex.RLock()
+	input, inOk := s.inputPlugins[inputName]
+	output, outOk := s.outputPlugins[outputName]
+	s.mutex.RUnlock()
+	if !inOk {
+		return nil, fmt.Errorf("input plugin '%s' not found", inputName)
+	}
+	if !outOk {
+		return nil, fmt.Errorf("output plugin '%s' not found", outputName)
+	}
+
+	endpoint := &Endpoint{Input: input, Output: output}
+	if err := s.RegisterEndpoint(endpoint); nil != err {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func endpointId(inputName, outputName string) string {
+	return inputName + "->" + outputName
+}
+
 func (s *Scheduler) RegisterEndpoint(endpoint *Endpoint) error {
-	if nil == endpoint {
+	if nil == endpoint || nil == endpoint.Input || nil == endpoint.Output {
 		return errors.New("invalid params")
 	}
 	if s.exit {
 		return errors.New("Scheduler already closed")
 	}
+	endpoint.Id = endpointId(endpoint.Input.GetPluginName(), endpoint.Output.GetPluginName())
+
+	s.mutex.Lock()
+	if _, ok := s.endpoints[endpoint.Id]; ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("endpoint '%s' already exist", endpoint.Id)
+	}
+	s.endpoints[endpoint.Id] = endpoint
+	// one transform per input plugin, so each message is written to all routed output plugins.
+	if !s.transforms[endpoint.Input] {
+		s.transforms[endpoint.Input] = true
+		go s.transform(endpoint.Input)
+	}
+	s.mutex.Unlock()
+
+	s.setInputMsgLevel()
+	log.Printf("Register Endpoint (Input-Plugin: %s, Output-Plugin: %s) \n", endpoint.Input.GetPluginName(), endpoint.Output.GetPluginName())
+	warnResponseMissing(endpoint)
+	return nil
+}
+
+// Output plugin learn from production response, but input plugin never attach it, such as correlation without mirror mode.
+func warnResponseMissing(endpoint *Endpoint) {
+	consumer, ok := endpoint.Output.(plugins.ResponseConsumer)
+	if !ok || !consumer.ConsumesResponse() {
+		return
+	}
+	if provider, ok := endpoint.Input.(plugins.ResponseProvider); ok && provider.ProvidesResponse() {
+		return
+	}
+	log.Printf("[Scheduler] warning: input plugin '%s' has no production response, correlation rules of output plugin '%s' never take effect.",
+		endpoint.Input.GetPluginName(), endpoint.Output.GetPluginName())
+}
+
+// Remove endpoint, plugins of endpoint keep running.
+func (s *Scheduler) RemoveEndpoint(id string) error {
+	s.mutex.Lock()
+	if _, ok := s.endpoints[id]; !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("endpoint '%s' not found", id)
+	}
+	delete(s.endpoints, id)
+	s.mutex.Unlock()
 
+	s.setInputMsgLevel()
+	log.Printf("Unregister Endpoint %s \n", id)
+	return nil
+}
+
+// Paused endpoint drop traffic of input plugin, other endpoints of input plugin are not affected.
+func (s *Scheduler) PauseEndpoint(id string) error {
+	return s.setEndpointPaused(id, true)
+}
+
+func (s *Scheduler) ResumeEndpoint(id string) error {
+	return s.setEndpointPaused(id, false)
+}
+
+func (s *Scheduler) setEndpointPaused(id string, paused bool) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.endpoints[endpoint.timeoutNano] = endpoint
-	go s.transform(endpoint)
+	endpoint, ok := s.endpoints[id]
+	if !ok {
+		return fmt.Errorf("endpoint '%s' not found", id)
+	}
+	endpoint.Paused = paused
 	return nil
 }
 
-func (s *Scheduler) transform(endpoint *Endpoint) {
-	if nil == endpoint {
+// Copy of endpoints, in id order.
+func (s *Scheduler) Endpoints() []Endpoint {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result := make([]Endpoint, 0, len(s.endpoints))
+	for _, endpoint := range s.endpoints {
+		result = append(result, *endpoint)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func (s *Scheduler) transform(input plugins.Plugin) {
+	if nil == input {
 		return
 	}
 	// step 1: write input-plugin traffic to output-plugin
 	timeout := time.Duration(50) * time.Millisecond
 	timer := time.NewTimer(timeout)
 	for {
-		if s.exit {
+		if s.exit || !s.isTransforming(input) {
 			return
 		}
 
 		select {
-		case data := <-endpoint.Input.GetMessage():
+		case data, ok := <-input.GetMessage():
+			if !ok {
+				// input plugin finished or closed, all it's messages are dispatched.
+				s.inputFinished(input)
+				return
+			}
 			// TODO: add middleware process
-			endpoint.Output.Write(data)
+			s.dispatch(input, data)
 		default:
 			<-timer.C
 			timer.Reset(timeout)
@@ -125,6 +391,133 @@ func (s *Scheduler) transform(endpoint *Endpoint) {
 	}
 }
 
+// Input plugin is transforming until it's removed.
+func (s *Scheduler) isTransforming(input plugins.Plugin) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.transforms[input]
+}
+
+// Write message to output plugins of running endpoints, nothing is written if input plugin is paused.
+// Output plugins are written after lock released, so slow output plugin never block scheduler,
+// write to removed output plugin fails after it's closed.
+func (s *Scheduler) dispatch(input plugins.Plugin, data *plugins.Message) {
+	s.mutex.RLock()
+	if s.stopped || s.pausedPlugins[input.GetPluginName()] {
+		s.mutex.RUnlock()
+		return
+	}
+	var outputs []plugins.Plugin
+	for _, endpoint := range s.endpoints {
+		if endpoint.Input != input || endpoint.Paused || s.pausedPlugins[endpoint.Output.GetPluginName()] {
+			continue
+		}
+		// output plugin only accept it's message level.
+		if data.GetMsgLevel()&endpoint.Output.GetMsgLevel() != 0 {
+			outputs = append(outputs, endpoint.Output)
+		}
+	}
+	s.mutex.RUnlock()
+
+	for _, output := range outputs {
+		output.Write(data)
+	}
+}
+
+// Input plugin is finished if it's still registered, closed channel of removed plugin is ignored.
+func (s *Scheduler) inputFinished(input plugins.Plugin) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := input.GetPluginName()
+	if s.inputPlugins[name] != input {
+		return
+	}
+	s.finished[name] = true
+	log.Printf("Input Plugin %s finished \n", name)
+	if reporter, ok := input.(plugins.ErrorReporter); ok {
+		if err := reporter.Err(); nil != err {
+			s.failedInputs[name] = err
+			log.Printf("Input Plugin %s finished with error: %v \n", name, err)
+		}
+	}
+	for name := range s.inputPlugins {
+		if !s.finished[name] {
+			return
+		}
+	}
+	s.finishOnce.Do(func() {
+		log.Print("Scheduler all input plugins finished.")
+		close(s.finishedChan)
+	})
+}
+
+// Input plugins which finished with error, input plugin name : error.
+func (s *Scheduler) FailedInputs() map[string]error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result := make(map[string]error, len(s.failedInputs))
+	for name, err := range s.failedInputs {
+		result[name] = err
+	}
+	return result
+}
+
+// Closed when all input plugins finished, such as all capture files are read, live input never finish.
+func (s *Scheduler) Finished() <-chan struct{} {
+	return s.finishedChan
+}
+
+// Wait output plugins send pending messages, return false if timeout.
+func (s *Scheduler) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := s.pending()
+		if pending == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Scheduler drain timeout, %d messages are not sent.", pending)
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *Scheduler) pending() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	pending := 0
+	for _, output := range s.outputPlugins {
+		if drainer, ok := output.(plugins.Drainer); ok {
+			pending += drainer.Pending()
+		} else {
+			pending += len(output.GetMessage())
+		}
+	}
+	return pending
+}
+
+// Stop replay, input plugins keep running and their traffic is dropped.
+func (s *Scheduler) StopReplay() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	log.Print("Scheduler stop replay.")
+}
+
+func (s *Scheduler) StartReplay() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = false
+	log.Print("Scheduler start replay.")
+}
+
+func (s *Scheduler) IsReplaying() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return !s.stopped && !s.exit
+}
+
 func (s *Scheduler) Close() {
 	s.exit = true
 }
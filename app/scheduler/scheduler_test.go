@@ -0,0 +1,27 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailedInputs(t *testing.T) {
+	s := NewScheduler()
+	defer s.Close()
+	if err := s.Init(newTestConfig(testPlugins{"in": nil, "failed-in": {"err": "read capture file fail"}}, testPlugins{"out": nil})); nil != err {
+		t.Fatalf("init fail, cause: %v", err)
+	}
+	for _, name := range []string{"in", "failed-in"} {
+		close(runningPlugin(s, name).(*testPlugin).receiveChan)
+	}
+
+	select {
+	case <-s.Finished():
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler is not finished after all inputs finished")
+	}
+	failedInputs := s.FailedInputs()
+	if len(failedInputs) != 1 || nil == failedInputs["failed-in"] {
+		t.Fatalf("failed inputs expect [failed-in], actual %v", failedInputs)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"sort"
+	"sync"
+)
+
+const healthStatusOk = "ok"
+
+var HealthService = &healthService{checkers: make(map[string]HealthChecker)}
+
+// Return nil if component is healthy, otherwise the reason.
+type HealthChecker func() error
+
+// Collect health of plugins and scheduler, help expose /-/healthz.
+type healthService struct {
+	mutex    sync.RWMutex
+	checkers map[string]HealthChecker
+}
+
+func (s *healthService) Register(name string, checker HealthChecker) {
+	if nil == checker {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkers[name] = checker
+}
+
+func (s *healthService) Unregister(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.checkers, name)
+}
+
+// Check all components, healthy only if all components are healthy.
+func (s *healthService) Check() (healthy bool, status map[string]string) {
+	s.mutex.RLock()
+	names := make([]string, 0, len(s.checkers))
+	for name := range s.checkers {
+		names = append(names, name)
+	}
+	s.mutex.RUnlock()
+	sort.Strings(names)
+
+	healthy = true
+	status = make(map[string]string, len(names))
+	for _, name := range names {
+		s.mutex.RLock()
+		checker, ok := s.checkers[name]
+		s.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := checker(); nil != err {
+			healthy = false
+			status[name] = err.Error()
+		} else {
+			status[name] = healthStatusOk
+		}
+	}
+	return healthy, status
+}
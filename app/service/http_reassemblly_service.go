@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
+	"github.com/google/gopacket/reassembly"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"time"
+	"xtransform/app/common/tcpreader"
 	"xtransform/app/listener"
 )
 
@@ -25,13 +25,16 @@ type httpAssemblyService struct {
 	bpfFilter    string
 	redirectUrl  *url.URL
 	IsDebug      bool
-	exitChan     chan bool
+
+	assemblerOptions *tcpreader.AssemblerOptions // tcp reassembly memory limit
+	exitChan         chan bool
 
 	// stat request info, contain success, fail and other.
 	counter map[string]int64
 }
 
-func NewHttpAssemblyService(deviceName, pcapFilename, bpfFileter string, redirectUrl string) (*httpAssemblyService, error) {
+// Default tcp reassembly limit is used if assemblerOptions is nil.
+func NewHttpAssemblyService(deviceName, pcapFilename, bpfFileter string, redirectUrl string, assemblerOptions *tcpreader.AssemblerOptions) (*httpAssemblyService, error) {
 	if (len(bpfFileter) == 0 || len(redirectUrl) == 0) && len(deviceName) == 0 && len(pcapFilename) == 0 {
 		return nil, errors.New("params is empty")
 	}
@@ -42,6 +45,10 @@ func NewHttpAssemblyService(deviceName, pcapFilename, bpfFileter string, redirec
 		return nil, err
 	}
 
+	if nil == assemblerOptions {
+		assemblerOptions = tcpreader.NewAssemblerOptions(0, 0, 0, 0)
+	}
+
 	service := &httpAssemblyService{
 		deviceName:   deviceName,
 		pcapFilename: pcapFilename,
@@ -50,6 +57,8 @@ func NewHttpAssemblyService(deviceName, pcapFilename, bpfFileter string, redirec
 		IsDebug:      false,
 		exitChan:     make(chan bool),
 		counter:      make(map[string]int64),
+
+		assemblerOptions: assemblerOptions,
 	}
 	httpAssemblySrc = service
 	return httpAssemblySrc, nil
@@ -89,9 +98,9 @@ func (h *httpAssemblyService) Stop() {
 
 func (h *httpAssemblyService) reassembly(packetsChan <-chan gopacket.Packet) {
 	streamFactory := &httpStreamFactory{}
-	streamPool := tcpassembly.NewStreamPool(streamFactory)
-	assembler := tcpassembly.NewAssembler(streamPool)
-	ticker := time.Tick(time.Minute)
+	assembler := tcpreader.NewAssembler(streamFactory, h.assemblerOptions)
+
+	ticker := time.Tick(h.assemblerOptions.OutOfOrderTimeout / 2)
 	for {
 		select {
 		case packet := <-packetsChan:
@@ -107,17 +116,18 @@ func (h *httpAssemblyService) reassembly(packetsChan <-chan gopacket.Packet) {
 				continue
 			}
 			tcp := packet.TransportLayer().(*layers.TCP)
-			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+			ctx := &tcpreader.AssemblerContext{CaptureInfo: packet.Metadata().CaptureInfo}
+			assembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, ctx)
 
 		case <-ticker:
-			// Every minute, flush connections that haven't seen activity in the past 2 minutes.
-			assembler.FlushOlderThan(time.Now().Add(time.Minute * -2))
+			// Stop waiting out of order data after timeout, close connection which has no activity,
+			// traffic is captured on live, so flush by wall clock.
+			assembler.FlushWithOptions(h.assemblerOptions.FlushOptions(time.Now()))
 
 		case <-h.exitChan:
 			return
 		}
 	}
-	h.exitChan <- true
 }
 
 func (h *httpAssemblyService) redirect(req *http.Request) {
@@ -156,29 +166,57 @@ type httpStreamFactory struct{}
 // httpStream will handle the actual decoding of http requests.
 type httpStream struct {
 	netFlow, tcpFlow gopacket.Flow
-	reader           tcpreader.ReaderStream
+	closed           bool // client sent FIN or RST
+	reader           *tcpreader.ReaderStream
 }
 
-func (factory *httpStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
-	reader := tcpreader.NewReaderStream()
-	reader.LossErrors = false
+func (factory *httpStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 	httpStream := &httpStream{
 		netFlow: netFlow,
 		tcpFlow: tcpFlow,
-		reader:  reader,
+		reader:  tcpreader.NewReaderStream(),
 	}
 	go httpStream.run() // start process http request
-	return &httpStream.reader
+	return httpStream
+}
+
+func (h *httpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if h.closed && dir == reassembly.TCPDirClientToServer {
+		return false
+	}
+	*start = true
+	return true
+}
+
+func (h *httpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
+	dir, _, end, _ := sg.Info()
+	if dir != reassembly.TCPDirClientToServer {
+		return
+	}
+	length, _ := sg.Lengths()
+	h.reader.Feed(sg.Fetch(length))
+	if end {
+		h.closed = true
+		h.reader.Close()
+	}
+}
+
+func (h *httpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	h.closed = true
+	h.reader.Close()
+	return true
 }
 
 func (h *httpStream) run() {
-	buf := bufio.NewReader(&h.reader)
+	buf := bufio.NewReader(h.reader)
 	for {
 		if req, err := http.ReadRequest(buf); err == io.EOF {
 			// We must read until we see an EOF... very important!
 			return
 		} else if err != nil {
 			log.Println("Error reading stream", h.netFlow, h.tcpFlow, ":", err)
+			h.reader.Discard()
+			return
 		} else {
 			// redirect
 			httpAssemblySrc.redirect(req)
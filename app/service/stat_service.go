@@ -1,27 +1,423 @@
 package service
 
-import "fmt"
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"xtransform/app/common/comparison"
+)
 
-var HttpStatService *httpStatService
+const (
+	maxRecentErrors     = 100  // keep recent error records
+	maxRecentDiffs      = 50   // keep recent diff records
+	maxRecentDivergence = 50   // keep recent divergence records of broadcast
+	maxDiffBodyBytes    = 4096 // body in diff record is truncated
+	maxLatencySamples   = 1024 // keep recent round trip time for percentiles
+	throughputWindowSec = 60   // keep per second throughput of recent seconds
+)
+
+var HttpStatService = &httpStatService{
+	statusCodes: make(map[int]int64),
+	latencies:   make([]int64, 0, maxLatencySamples),
+}
 
 // Statistics http request result
 type HttpStatEntry struct {
+	MsgId        string
+	ConnId       string
+	ClientAddr   string
+	InputPlugin  string
+	OutputPlugin string
+	Target       string // target name of broadcast output
+
 	ReqUrl string
 
 	ResStatusCode int
+	ResHeader     http.Header
 	ResBody       []byte
 
-	Err error
+	ProdResponse []byte // production response dump of request, only exist in mirror mode
+
+	Err     error
+	Retries int // retry count of request
 
 	RoundTripTimeNano int64
 	StartTimeNano     int64
 }
 
+// Failed request record, help find out why replay failed.
+type HttpErrorRecord struct {
+	TimeNano     int64  `json:"time_nano"`
+	MsgId        string `json:"msg_id"`
+	OutputPlugin string `json:"output_plugin"`
+	ReqUrl       string `json:"req_url"`
+	StatusCode   int    `json:"status_code"`
+	Retries      int    `json:"retries"`
+	Err          string `json:"err"`
+}
+
+// Production response is different with replay response.
+type HttpDiffRecord struct {
+	TimeNano     int64  `json:"time_nano"`
+	MsgId        string `json:"msg_id"`
+	OutputPlugin string `json:"output_plugin"`
+	ReqUrl       string `json:"req_url"`
+	ProdStatus   int    `json:"prod_status"`
+	ReplayStatus int    `json:"replay_status"`
+	ProdBody     string `json:"prod_body"` // truncated
+	ReplayBody   string `json:"replay_body"`
+}
+
+// Responses of broadcast targets are different, first target is baseline.
+type HttpDivergenceRecord struct {
+	TimeNano     int64                 `json:"time_nano"`
+	MsgId        string                `json:"msg_id"`
+	OutputPlugin string                `json:"output_plugin"`
+	ReqUri       string                `json:"req_uri"` // request uri of original request
+	Responses    []*HttpTargetResponse `json:"responses"`
+}
+
+type HttpTargetResponse struct {
+	Target string `json:"target"`
+	Status int    `json:"status"`
+	Body   string `json:"body"` // truncated
+	Err    string `json:"err"`
+}
+
+type HttpStatSnapshot struct {
+	Total       int64         `json:"total"`
+	Failed      int64         `json:"failed"`   // request error or 5xx response
+	Retries     int64         `json:"retries"`  // total retry count
+	Compared    int64         `json:"compared"` // replay response compared with production response
+	Diffed      int64         `json:"diffed"`
+	Broadcasts  int64         `json:"broadcasts"` // request broadcast to targets and compared between them
+	Diverged    int64         `json:"diverged"`
+	StatusCodes map[int]int64 `json:"status_codes"`
+
+	// latency of recent requests, in millisecond
+	LatencyP50Ms float64 `json:"latency_p50_ms"`
+	LatencyP90Ms float64 `json:"latency_p90_ms"`
+	LatencyP99Ms float64 `json:"latency_p99_ms"`
+	LatencyMaxMs float64 `json:"latency_max_ms"`
+
+	Throughput []ThroughputPoint `json:"throughput"` // per second, in time order
+}
+
+type ThroughputPoint struct {
+	Second   int64 `json:"second"` // unix second
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+}
+
 type httpStatService struct {
+	mutex sync.RWMutex
+
+	total       int64
+	failed      int64
+	retries     int64
+	statusCodes map[int]int64
+
+	compared   int64
+	diffed     int64
+	broadcasts int64
+	diverged   int64
+
+	recentErrors []*HttpErrorRecord // ring buffer
+	errorIndex   int
+	recentDiffs  []*HttpDiffRecord // ring buffer
+	diffIndex    int
+	divergences  []*HttpDivergenceRecord // ring buffer
+	divergeIndex int
+	latencies    []int64 // ring buffer
+	latencyIndex int
+	throughput   [throughputWindowSec]ThroughputPoint // index by unix second
+
+	IsDebug bool
 }
 
 func (s *httpStatService) Stat(entry *HttpStatEntry) {
-	// TODO
-	c := fmt.Sprintf("request url: %v, response status code: %v, err: %v \n", entry.ReqUrl, entry.ResStatusCode, entry.Err)
-	fmt.Println(c)
+	if nil == entry {
+		return
+	}
+	if s.IsDebug {
+		fmt.Printf("request url: %v, response status code: %v, err: %v \n", entry.ReqUrl, entry.ResStatusCode, entry.Err)
+	}
+	failed := nil != entry.Err || entry.ResStatusCode >= 500
+	// parse and decompress production response before lock, lock is held for counters and ring buffers only.
+	var compared bool
+	var diff *HttpDiffRecord
+	if nil == entry.Err && len(entry.ProdResponse) > 0 {
+		compared, diff = compareProdResponse(entry)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// step 1: counter
+	s.total++
+	s.retries += int64(entry.Retries)
+	if nil == entry.Err {
+		s.statusCodes[entry.ResStatusCode]++
+	}
+
+	// step 2: throughput
+	second := time.Now().Unix()
+	point := &s.throughput[second%throughputWindowSec]
+	if point.Second != second {
+		*point = ThroughputPoint{Second: second}
+	}
+	point.Requests++
+
+	// step 3: latency, error request has no response.
+	if nil == entry.Err {
+		if len(s.latencies) < maxLatencySamples {
+			s.latencies = append(s.latencies, entry.RoundTripTimeNano)
+		} else {
+			s.latencies[s.latencyIndex] = entry.RoundTripTimeNano
+			s.latencyIndex = (s.latencyIndex + 1) % maxLatencySamples
+		}
+	}
+
+	// step 4: diff record
+	if compared {
+		s.compared++
+	}
+	if nil != diff {
+		s.diffed++
+		if len(s.recentDiffs) < maxRecentDiffs {
+			s.recentDiffs = append(s.recentDiffs, diff)
+		} else {
+			s.recentDiffs[s.diffIndex] = diff
+			s.diffIndex = (s.diffIndex + 1) % maxRecentDiffs
+		}
+	}
+
+	if !failed {
+		return
+	}
+	// step 5: error record
+	s.failed++
+	point.Errors++
+	record := &HttpErrorRecord{
+		TimeNano:     entry.StartTimeNano,
+		MsgId:        entry.MsgId,
+		OutputPlugin: entry.OutputPlugin,
+		ReqUrl:       entry.ReqUrl,
+		StatusCode:   entry.ResStatusCode,
+		Retries:      entry.Retries,
+	}
+	if nil != entry.Err {
+		record.Err = entry.Err.Error()
+	}
+	if len(s.recentErrors) < maxRecentErrors {
+		s.recentErrors = append(s.recentErrors, record)
+	} else {
+		s.recentErrors[s.errorIndex] = record
+		s.errorIndex = (s.errorIndex + 1) % maxRecentErrors
+	}
+}
+
+func (s *httpStatService) Snapshot() *HttpStatSnapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	snapshot := &HttpStatSnapshot{
+		Total:       s.total,
+		Failed:      s.failed,
+		Retries:     s.retries,
+		Compared:    s.compared,
+		Diffed:      s.diffed,
+		Broadcasts:  s.broadcasts,
+		Diverged:    s.diverged,
+		StatusCodes: make(map[int]int64, len(s.statusCodes)),
+	}
+	for code, count := range s.statusCodes {
+		snapshot.StatusCodes[code] = count
+	}
+
+	// latency percentiles
+	if len(s.latencies) > 0 {
+		latencies := append([]int64{}, s.latencies...)
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		percentile := func(p float64) float64 {
+			return float64(latencies[int(float64(len(latencies)-1)*p)]) / float64(time.Millisecond)
+		}
+		snapshot.LatencyP50Ms = percentile(0.5)
+		snapshot.LatencyP90Ms = percentile(0.9)
+		snapshot.LatencyP99Ms = percentile(0.99)
+		snapshot.LatencyMaxMs = percentile(1)
+	}
+
+	// throughput of recent seconds, missing second is zero.
+	now := time.Now().Unix()
+	for second := now - throughputWindowSec + 1; second <= now; second++ {
+		point := s.throughput[second%throughputWindowSec]
+		if point.Second != second {
+			point = ThroughputPoint{Second: second}
+		}
+		snapshot.Throughput = append(snapshot.Throughput, point)
+	}
+	return snapshot
+}
+
+// Recent error records, latest first.
+func (s *httpStatService) RecentErrors(limit int) []*HttpErrorRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	size := len(s.recentErrors)
+	if limit <= 0 || limit > size {
+		limit = size
+	}
+	records := make([]*HttpErrorRecord, 0, limit)
+	// the latest one is before errorIndex when ring buffer is full.
+	latest := size - 1
+	if size == maxRecentErrors {
+		latest = (s.errorIndex - 1 + size) % size
+	}
+	for i := 0; i < limit; i++ {
+		records = append(records, s.recentErrors[(latest-i+size)%size])
+	}
+	return records
+}
+
+// Compare replay response with production response by status code and body,
+// returns whether it's compared, and diff record if they're different.
+func compareProdResponse(entry *HttpStatEntry) (bool, *HttpDiffRecord) {
+	prodRes, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(entry.ProdResponse)), nil)
+	if nil != err {
+		return false, nil
+	}
+	defer prodRes.Body.Close()
+	// replay response is decompressed by http client, so decompress production response too.
+	var prodBodyReader io.Reader = prodRes.Body
+	if strings.EqualFold(prodRes.Header.Get("Content-Encoding"), "gzip") {
+		if prodBodyReader, err = gzip.NewReader(prodRes.Body); nil != err {
+			return false, nil
+		}
+	}
+	prodBody, err := ioutil.ReadAll(prodBodyReader)
+	if nil != err {
+		return false, nil
+	}
+
+	if prodRes.StatusCode == entry.ResStatusCode && bytes.Equal(prodBody, entry.ResBody) {
+		return true, nil
+	}
+	return true, &HttpDiffRecord{
+		TimeNano:     entry.StartTimeNano,
+		MsgId:        entry.MsgId,
+		OutputPlugin: entry.OutputPlugin,
+		ReqUrl:       entry.ReqUrl,
+		ProdStatus:   prodRes.StatusCode,
+		ReplayStatus: entry.ResStatusCode,
+		ProdBody:     truncateBody(prodBody),
+		ReplayBody:   truncateBody(entry.ResBody),
+	}
+}
+
+// Recent diff records, latest first.
+func (s *httpStatService) RecentDiffs(limit int) []*HttpDiffRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	size := len(s.recentDiffs)
+	if limit <= 0 || limit > size {
+		limit = size
+	}
+	records := make([]*HttpDiffRecord, 0, limit)
+	latest := size - 1
+	if size == maxRecentDiffs {
+		latest = (s.diffIndex - 1 + size) % size
+	}
+	for i := 0; i < limit; i++ {
+		records = append(records, s.recentDiffs[(latest-i+size)%size])
+	}
+	return records
+}
+
+// Stat responses of one request broadcast to targets, report divergence between targets rather than versus production.
+// Responses are compared by comparator, ignored parts of responses are not compared.
+func (s *httpStatService) StatBroadcast(reqUri string, entries []*HttpStatEntry, comparator *comparison.Comparator) {
+	if len(entries) == 0 {
+		return
+	}
+	for _, entry := range entries {
+		s.Stat(entry)
+	}
+
+	baseline, diverged := entries[0], false
+	baselineRes := &comparison.Response{Status: baseline.ResStatusCode, Header: baseline.ResHeader, Body: baseline.ResBody}
+	for _, entry := range entries[1:] {
+		if (nil == entry.Err) != (nil == baseline.Err) {
+			diverged = true
+			break
+		}
+		if nil != entry.Err {
+			continue
+		}
+		if !comparator.Equal(baselineRes, &comparison.Response{Status: entry.ResStatusCode, Header: entry.ResHeader, Body: entry.ResBody}) {
+			diverged = true
+			break
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.broadcasts++
+	if !diverged {
+		return
+	}
+	s.diverged++
+	record := &HttpDivergenceRecord{
+		TimeNano:     baseline.StartTimeNano,
+		MsgId:        baseline.MsgId,
+		OutputPlugin: baseline.OutputPlugin,
+		ReqUri:       reqUri,
+	}
+	for _, entry := range entries {
+		response := &HttpTargetResponse{Target: entry.Target, Status: entry.ResStatusCode, Body: truncateBody(entry.ResBody)}
+		if nil != entry.Err {
+			response.Err = entry.Err.Error()
+		}
+		record.Responses = append(record.Responses, response)
+	}
+	if len(s.divergences) < maxRecentDivergence {
+		s.divergences = append(s.divergences, record)
+	} else {
+		s.divergences[s.divergeIndex] = record
+		s.divergeIndex = (s.divergeIndex + 1) % maxRecentDivergence
+	}
+}
+
+// Recent divergence records of broadcast, latest first.
+func (s *httpStatService) RecentDivergences(limit int) []*HttpDivergenceRecord {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	size := len(s.divergences)
+	if limit <= 0 || limit > size {
+		limit = size
+	}
+	records := make([]*HttpDivergenceRecord, 0, limit)
+	latest := size - 1
+	if size == maxRecentDivergence {
+		latest = (s.divergeIndex - 1 + size) % size
+	}
+	for i := 0; i < limit; i++ {
+		records = append(records, s.divergences[(latest-i+size)%size])
+	}
+	return records
+}
+
+func truncateBody(body []byte) string {
+	if len(body) > maxDiffBodyBytes {
+		return string(body[:maxDiffBodyBytes]) + "..."
+	}
+	return string(body)
 }
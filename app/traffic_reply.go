@@ -9,10 +9,25 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"xtransform/app/common/httpclient"
 	"xtransform/app/config"
+	"xtransform/app/controller"
 	"xtransform/app/listener"
 	"xtransform/app/scheduler"
+	"xtransform/app/service"
+)
+
+const (
+	inputRawEnginePcap      = "pcap"
+	inputRawEngineRawSocket = "raw_socket"
+)
+
+// Exit code after all input finished, such as capture files are replayed.
+const (
+	exitCodeDrainTimeout  = 3 // pending requests are not sent before drain timeout
+	exitCodeRequestFailed = 4 // some requests failed, only if --fail-on-error
+	exitCodeInputFailed   = 5 // some input finished with error, such as capture file read fail
 )
 
 // TODO: add current version
@@ -22,11 +37,19 @@ func usage() {
 	os.Exit(2)
 }
 
+var configFile = flag.String("config", "", "Yaml config file, plugins in config are created by registered plugin factory. such as: --config ./app.yaml")
 var IsDebug = flag.Bool("debug", false, "Debug mode, true is turn on debug mode, show all intercepted traffic.")
 var inputHttpPort = flag.Int("input-http", -1, "Read http request in local http server, it's need to assign a port run http service.")
 var outputHttpRedirectUrl = flag.String("output-http", "", "Forwards incoming requests to given http address. such as: --input-http 80 --output-http http://abc.com")
 
 var inputRawOnLivePort = flag.Int("input-raw", -1, "Capture traffic in current active net interface card, listen special port traffic. such as: --input-raw 80 --output-http http://abc.com")
+var inputFile = flag.String("input-file", "", "Replay capture file, it's pcap or pcapng, may be gzip or zstd compressed, or directory or glob of rotated files. exit after all requests are sent, exit with code 5 if capture files fail to read. such as: --input-file './dump/*.pcap.gz' --output-http http://abc.com")
+var drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "Max time to wait pending requests sent after all input finished, exit with code 3 if timeout.")
+var failOnError = flag.Bool("fail-on-error", false, "Exit with code 4 after all input finished if any request failed (error or 5xx response). such as: --input-file ./dump.pcap --fail-on-error")
+var inputRawEngine = flag.String("input-raw-engine", inputRawEnginePcap, "Capture engine of --input-raw, 'pcap' use libpcap, 'raw_socket' use AF_PACKET socket (linux only, need CAP_NET_RAW).")
+
+var adminPort = flag.Int("admin-port", -1, "Run admin api on given port, it's bound to 127.0.0.1 by default. such as: --admin-port 8081 --admin-token abc")
+var adminToken = flag.String("admin-token", "", "Token of admin api, request must carry 'Authorization: Bearer {token}'.")
 
 var outputTcpAddr = flag.String("output-tcp", "", "Forwards incoming packet to given tcp address. such as: --input-http 80 --output-tcp 127.0.0.1:8888")
 
@@ -34,33 +57,68 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	*inputRawOnLivePort = 3800
-	*outputHttpRedirectUrl = "http://127.0.0.1:3800/ab"
-	*outputTcpAddr = "127.0.0.1:3800"
-
 	fmt.Println("==============================")
+	fmt.Println("config: ", *configFile)
 	fmt.Println("input-http: ", *inputHttpPort)
 	fmt.Println("input-raw: ", *inputRawOnLivePort)
+	fmt.Println("input-raw-engine: ", *inputRawEngine)
+	fmt.Println("input-file: ", *inputFile)
 	fmt.Println("output-http: ", *outputHttpRedirectUrl)
 	fmt.Println("output-tcp: ", *outputTcpAddr)
 	fmt.Println("==============================")
 
 	// step 1: init app config
-	appConfig := initAppConfig()
+	appConfig, err := initAppConfig()
+	if nil != err {
+		panic(err)
+	}
 
 	// step 2: register plugin
-	scheduler := scheduler.NewScheduler()
-	err := scheduler.Init(appConfig)
+	appScheduler := scheduler.NewScheduler()
+	err = appScheduler.Init(appConfig)
 	if nil != err {
 		panic(err)
 	}
 
-	handleSignal(scheduler)
-	log.Print("Traffic Reply exit. \n")
+	// step 3: start admin server
+	var adminServer *controller.AdminServer
+	if nil != appConfig.Admin && appConfig.Admin.Port > 0 {
+		if adminServer, err = controller.NewAdminServer(appConfig.Admin, appScheduler); nil != err {
+			panic(err)
+		}
+		if err = adminServer.Start(); nil != err {
+			panic(err)
+		}
+	}
+
+	// step 4: watch config file
+	var configWatcher *scheduler.ConfigWatcher
+	if len(strings.TrimSpace(*configFile)) > 0 {
+		if configWatcher, err = scheduler.NewConfigWatcher(*configFile, initAppConfig, appScheduler, appConfig.ReloadIntervalMs); nil != err {
+			panic(err)
+		}
+	}
+
+	exitCode := handleSignal(appScheduler, configWatcher)
+	if nil != configWatcher {
+		configWatcher.Close()
+	}
+	if nil != adminServer {
+		adminServer.Close()
+	}
+	log.Printf("Traffic Reply exit, code: %d. \n", exitCode)
+	os.Exit(exitCode)
 }
 
-func initAppConfig() *config.AppConfig {
+// Load config file first, plugins of command line flags are appended to it.
+func initAppConfig() (*config.AppConfig, error) {
 	appConfig := &config.AppConfig{}
+	if len(strings.TrimSpace(*configFile)) > 0 {
+		var err error
+		if appConfig, err = config.InitConfig(*configFile); nil != err {
+			return nil, err
+		}
+	}
 
 	// case 1: http input plugin
 	if *inputHttpPort > 0 {
@@ -88,25 +146,74 @@ func initAppConfig() *config.AppConfig {
 	// case 3: raw packet input plugin
 	if *inputRawOnLivePort > 0 {
 		rawInputPluginConfig := &config.RawInputConfig{
-			RawSocketAddr: ":" + strconv.Itoa(*inputRawOnLivePort),
-			PcapFilename:  "",
-			DeviceName:    listener.AllDevice, // default capture all NICs traffic
-			BpfFilter:     "tcp and dst port " + strconv.Itoa(*inputRawOnLivePort),
+			PcapFilename: "",
+		}
+		if *inputRawEngine == inputRawEngineRawSocket {
+			rawInputPluginConfig.RawSocketAddr = ":" + strconv.Itoa(*inputRawOnLivePort) // default capture all NICs traffic
+		} else {
+			rawInputPluginConfig.DeviceName = listener.AllDevice // default capture all NICs traffic
+			rawInputPluginConfig.BpfFilter = "tcp and dst port " + strconv.Itoa(*inputRawOnLivePort)
 		}
 		appConfig.RawInputPluginConfig = rawInputPluginConfig
 	}
 
-	// case 4: tcp output plugin
+	// case 4: capture file input, it's read by raw input plugin too.
+	if len(strings.TrimSpace(*inputFile)) > 0 {
+		if nil == appConfig.RawInputPluginConfig {
+			appConfig.RawInputPluginConfig = &config.RawInputConfig{}
+		}
+		appConfig.RawInputPluginConfig.PcapFilename = *inputFile
+	}
+
+	// case 5: tcp output plugin
 	if *outputTcpAddr != "" {
 		appConfig.TcpOutputPluginConfig = *outputTcpAddr
 	}
 
-	return appConfig
+	// case 6: admin api
+	if *adminPort > 0 {
+		appConfig.Admin = &config.AdminConfig{Port: *adminPort, Token: *adminToken}
+	}
+
+	return appConfig, nil
 }
 
-func handleSignal(scheduler *scheduler.Scheduler) {
+// SIGHUP reload config file, other signals close scheduler.
+// Scheduler is closed after pending requests sent if all input plugins finished, such as capture files are read,
+// return non zero exit code if drain timeout, input failed or requests failed.
+func handleSignal(scheduler *scheduler.Scheduler, configWatcher *scheduler.ConfigWatcher) int {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	<-sigs
-	scheduler.Close()
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				scheduler.Close()
+				return 0
+			}
+			if nil == configWatcher {
+				log.Print("Receive SIGHUP, but no config file to reload.")
+				continue
+			}
+			configWatcher.Reload()
+		case <-scheduler.Finished():
+			log.Printf("All input finished, wait pending requests sent in %s.", *drainTimeout)
+			drained := scheduler.Drain(*drainTimeout)
+			scheduler.Close()
+			if !drained {
+				return exitCodeDrainTimeout
+			}
+			if failedInputs := scheduler.FailedInputs(); len(failedInputs) > 0 {
+				for name, err := range failedInputs {
+					log.Printf("Input %s failed, cause: %v", name, err)
+				}
+				return exitCodeInputFailed
+			}
+			if failed := service.HttpStatService.Snapshot().Failed; *failOnError && failed > 0 {
+				log.Printf("%d requests failed.", failed)
+				return exitCodeRequestFailed
+			}
+			return 0
+		}
+	}
 }
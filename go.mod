@@ -1,10 +1,11 @@
 module xtransform
 
-go 1.12
+go 1.14
 
 require (
-	github.com/gin-gonic/gin v1.4.0 // indirect
+	github.com/gin-gonic/gin v1.4.0
 	github.com/google/gopacket v1.1.17
+	github.com/klauspost/compress v1.11.13
 	golang.org/x/net v0.0.0-20191028085509-fe3aa8a45271
 	gopkg.in/yaml.v2 v2.2.2
 )